@@ -16,13 +16,6 @@ mkdir $WORKSPACE/tmp
 cp -RL blobs/* $WORKSPACE/tmp
 cd $WORKSPACE/tmp
 
-# install mkisofs
-export BOSH_INSTALL_TARGET=$WORKSPACE/tools
-ls -l cpi_mkisofs/
-chmod +x ../cpi-release/packages/cpi_mkisofs/packaging
-../cpi-release/packages/cpi_mkisofs/packaging
-export PATH=$PATH:$WORKSPACE/tools/bin
-
 # install go
 export BOSH_INSTALL_TARGET=$WORKSPACE/tools/go
 mkdir $BOSH_INSTALL_TARGET
@@ -39,4 +32,4 @@ rm -rf $WORKSPACE/tmp
 cd $WORKSPACE/cpi-release
 
 export GOPATH=$WORKSPACE/cpi-release
-go test -v github.com/vmware/bosh-photon-cpi -ginkgo.noColor -ginkgo.slowSpecThreshold=60 -ginkgo.v
+go test -v github.com/vmware/bosh-photon-cpi github.com/vmware/bosh-photon-cpi/iso -ginkgo.noColor -ginkgo.slowSpecThreshold=60 -ginkgo.v
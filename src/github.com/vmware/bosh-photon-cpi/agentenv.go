@@ -10,31 +10,189 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/iso"
 	ec "github.com/vmware/photon-controller-go-sdk/photon"
-	"io/ioutil"
-	"os"
-	p "path"
-	"path/filepath"
+	"io"
+	"strings"
 )
 
 const metadataKey = "bosh-cpi"
 
+// Prefixes the VM tag that keeps the parts of the agent env that can't be derived
+// from the VM or the CPI config, so the agent env can be rebuilt when the bosh-cpi
+// metadata is lost. It is a tag since set_metadata replaces all metadata of a VM,
+// but leaves its tags alone.
+const recoveryTagPrefix = "bosh-cpi-recovery:"
+
+type agentEnvRecovery struct {
+	AgentID  string                 `json:"agent_id"`
+	Networks map[string]interface{} `json:"networks"`
+	Env      map[string]interface{} `json:"env"`
+}
+
+// Marks agent env metadata encrypted with AgentConfig.EnvEncryptionKey
+const encryptedMetadataPrefix = "encrypted:"
+
+// Stores the agent env of a VM where the BOSH agent can read it
+type agentEnvService interface {
+	// Makes the agent env available to a VM that has not been started yet
+	Create(vmID string, env *cpi.AgentEnv) error
+	Get(vmID string) (*cpi.AgentEnv, error)
+	Update(vmID string, env *cpi.AgentEnv) error
+	Delete(vmID string) error
+}
+
+func newAgentEnvService(ctx *cpi.Context) (agentEnvService, error) {
+	switch ctx.Config.AgentEnvService {
+	case "", cpi.FileAgentEnvService:
+		return &isoAgentEnvService{ctx: ctx}, nil
+	case cpi.RegistryAgentEnvService:
+		if ctx.Config.Registry == nil {
+			return nil, errors.New("Agent env service 'registry' requires registry config")
+		}
+		return newRegistryAgentEnvService(ctx, ctx.Config.Registry), nil
+	}
+	return nil, fmt.Errorf("Unknown agent env service '%s'", ctx.Config.AgentEnvService)
+}
+
+// Puts the agent env on an ISO attached to the VM and keeps a copy in the VM
+// metadata, so it can be read back when disks are attached or detached.
+type isoAgentEnvService struct {
+	ctx *cpi.Context
+}
+
+// The recovery tag is only set here, as tags can't be removed again and the
+// parts of the agent env it keeps don't change over the life of a VM
+func (s *isoAgentEnvService) Create(vmID string, env *cpi.AgentEnv) error {
+	err := putAgentEnvRecoveryTag(s.ctx, vmID, env)
+	if err != nil {
+		return err
+	}
+	return updateAgentEnv(s.ctx, vmID, env)
+}
+
+func (s *isoAgentEnvService) Get(vmID string) (*cpi.AgentEnv, error) {
+	return getOrRebuildAgentEnv(s.ctx, vmID)
+}
+
+func (s *isoAgentEnvService) Update(vmID string, env *cpi.AgentEnv) error {
+	return updateAgentEnv(s.ctx, vmID, env)
+}
+
+// The ISO and the metadata go away together with the VM
+func (s *isoAgentEnvService) Delete(vmID string) error {
+	return nil
+}
+
 func getAgentEnvMetadata(ctx *cpi.Context, vmID string) (res *cpi.AgentEnv, err error) {
 	vm, err := ctx.Client.VMs.Get(vmID)
 	if err != nil {
 		return
 	}
+	return parseAgentEnvMetadata(ctx, vm)
+}
+
+func parseAgentEnvMetadata(ctx *cpi.Context, vm *ec.VM) (res *cpi.AgentEnv, err error) {
 	metadata, ok := vm.Metadata[metadataKey]
 	if !ok {
-		err = fmt.Errorf("No metadata found with key '%s' for vm ID '%s'", metadataKey, vmID)
+		return nil, fmt.Errorf("No metadata found with key '%s' for vm ID '%s'", metadataKey, vm.ID)
+	}
+	envJson, err := decodeAgentEnvMetadata(ctx, metadata)
+	if err != nil {
+		return
 	}
 	res = &cpi.AgentEnv{}
-	err = json.Unmarshal([]byte(metadata), res)
+	err = json.Unmarshal(envJson, res)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metadata with key '%s' for vm ID '%s': %v", metadataKey, vm.ID, err)
+	}
+	return
+}
+
+// Reads the agent env from VM metadata. When the metadata is missing or corrupt,
+// e.g. because it was replaced by hand, the agent env is rebuilt from the VM, its
+// recovery tag and the CPI config, and written back to the metadata. The attached
+// ISO can't be read back through the Photon API, so it is no source for this.
+// Metadata that can't be decrypted with the configured key is an error rather
+// than corruption.
+func getOrRebuildAgentEnv(ctx *cpi.Context, vmID string) (res *cpi.AgentEnv, err error) {
+	vm, err := ctx.Client.VMs.Get(vmID)
+	if err != nil {
+		return
+	}
+	if metadata, ok := vm.Metadata[metadataKey]; ok {
+		if _, err = decodeAgentEnvMetadata(ctx, metadata); err != nil {
+			return nil, cpi.NewBoshError(cpi.CloudError, false,
+				"Failed to read agent env metadata of VM '%s', check the agent env encryption key: %v", vmID, err)
+		}
+	}
+	res, err = parseAgentEnvMetadata(ctx, vm)
+	if err == nil {
+		return
+	}
+
+	ctx.Logger.Warnf("Rebuilding agent env for VM '%s' as its metadata is unusable: %v", vmID, err)
+	res, err = rebuildAgentEnv(ctx, vm)
+	if err != nil {
+		return nil, cpi.NewBoshError(cpi.CloudError, false,
+			"Failed to rebuild agent env for VM '%s', recreate the VM: %v", vmID, err)
+	}
+	err = putAgentEnvMetadata(ctx, vmID, res)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Logger.Warnf("Rebuilt agent env for VM '%s' from its disks, its recovery tag and the CPI config", vmID)
+	return
+}
+
+func rebuildAgentEnv(ctx *cpi.Context, vm *ec.VM) (res *cpi.AgentEnv, err error) {
+	recovery, err := parseAgentEnvRecoveryTag(ctx, vm)
+	if err != nil {
+		return
+	}
+	if recovery.AgentID == "" {
+		return nil, errors.New("No agent ID recorded for VM")
+	}
+	if ctx.Config.Agent == nil {
+		return nil, errors.New("No agent config found")
+	}
+
+	persistent := map[string]interface{}{}
+	for _, diskID := range persistentDiskIDs(vm) {
+		persistent[diskID] = getDiskHint(diskID)
+	}
+	disks := map[string]interface{}{"persistent": persistent}
+	for _, disk := range vm.AttachedDisks {
+		if disk.Name == ephemeralDiskName {
+			disks["ephemeral"] = map[string]interface{}{
+				"id":   disk.ID,
+				"path": ephemeralDiskPath}
+		}
+	}
+
+	res = &cpi.AgentEnv{
+		AgentID:  recovery.AgentID,
+		VM:       cpi.VMSpec{Name: vm.Name, ID: vm.ID},
+		Networks: recovery.Networks,
+		Env:      recovery.Env,
+		Mbus:     ctx.Config.Agent.Mbus,
+		NTP:      ctx.Config.Agent.NTP,
+		Disks:    disks,
+		Blobstore: cpi.BlobstoreSpec{
+			Provider: ctx.Config.Agent.Blobstore.Provider,
+			Options:  ctx.Config.Agent.Blobstore.Options,
+		},
+	}
 	return
 }
 
@@ -43,61 +201,219 @@ func putAgentEnvMetadata(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err
 	if err != nil {
 		return
 	}
-	envString := string(envJson[:])
-	metadata := &ec.VmMetadata{map[string]string{metadataKey: envString}}
+	envString, err := encodeAgentEnvMetadata(ctx, envJson)
+	if err != nil {
+		return
+	}
+
+	// Keep any other metadata on the VM, e.g. from set_vm_metadata
+	vm, err := ctx.Client.VMs.Get(vmID)
+	if err != nil {
+		return
+	}
+	vmMetadata := map[string]string{}
+	for key, value := range vm.Metadata {
+		vmMetadata[key] = value
+	}
+	vmMetadata[metadataKey] = envString
+	metadata := &ec.VmMetadata{Metadata: vmMetadata}
 	// Task returns instantly for SetMetadata
 	_, err = ctx.Client.VMs.SetMetadata(vmID, metadata)
 	return
 }
 
-func createEnvISO(env *cpi.AgentEnv, runner cmd.Runner) (path string, err error) {
-	json, err := json.Marshal(env)
+// The record holds the director env settings, e.g. bosh.password, so it is encrypted
+// like the agent env metadata, and base64 encoded to keep the tag a single word
+func putAgentEnvRecoveryTag(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
+	recoveryJson, err := json.Marshal(&agentEnvRecovery{AgentID: env.AgentID, Networks: env.Networks, Env: env.Env})
 	if err != nil {
 		return
 	}
-	envDir, err := ioutil.TempDir("", "agent-iso-dir")
+	recoveryString, err := encodeAgentEnvMetadata(ctx, recoveryJson)
 	if err != nil {
 		return
 	}
-	// Name of the environment JSON file should be "env" to fit ISO 9660 8.3 filename scheme
-	envFile, err := os.Create(p.Join(envDir, "env"))
+	tag := recoveryTagPrefix + base64.RawURLEncoding.EncodeToString([]byte(recoveryString))
+
+	ctx.Logger.Info("Setting agent env recovery tag on VM")
+	task, err := ctx.Client.VMs.SetTag(vmID, &ec.VmTag{Tag: tag})
 	if err != nil {
 		return
 	}
-	_, err = envFile.Write(json)
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	_, err = ctx.Client.Tasks.Wait(task.ID)
+	return
+}
+
+func parseAgentEnvRecoveryTag(ctx *cpi.Context, vm *ec.VM) (res *agentEnvRecovery, err error) {
+	for _, tag := range vm.Tags {
+		if !strings.HasPrefix(tag, recoveryTagPrefix) {
+			continue
+		}
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(tag, recoveryTagPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid agent env recovery tag: %v", err)
+		}
+		recoveryJson, err := decodeAgentEnvMetadata(ctx, string(data))
+		if err != nil {
+			return nil, err
+		}
+		res = &agentEnvRecovery{}
+		err = json.Unmarshal(recoveryJson, res)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid agent env recovery tag: %v", err)
+		}
+		return res, nil
+	}
+	// VMs created by older CPI versions or only partially created have no tag
+	return nil, fmt.Errorf("No tag found with prefix '%s'", recoveryTagPrefix)
+}
+
+func envEncryptionKey(ctx *cpi.Context) string {
+	if ctx.Config.Agent == nil {
+		return ""
+	}
+	return ctx.Config.Agent.EnvEncryptionKey
+}
+
+// The agent env holds the mbus and blobstore credentials, so when a key is
+// configured it is encrypted before it is stored in VM metadata where anyone
+// who can read the VM would see it.
+func encodeAgentEnvMetadata(ctx *cpi.Context, envJson []byte) (res string, err error) {
+	key := envEncryptionKey(ctx)
+	if key == "" {
+		return string(envJson[:]), nil
+	}
+	gcm, err := newEnvCipher(key)
 	if err != nil {
 		return
 	}
-	err = envFile.Close()
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		return
 	}
+	sealed := gcm.Seal(nonce, nonce, envJson, nil)
+	return encryptedMetadataPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
 
-	envISO, err := ioutil.TempFile("", "agent-env-iso")
+func decodeAgentEnvMetadata(ctx *cpi.Context, metadata string) (res []byte, err error) {
+	if !strings.HasPrefix(metadata, encryptedMetadataPrefix) {
+		return []byte(metadata), nil
+	}
+	key := envEncryptionKey(ctx)
+	if key == "" {
+		return nil, errors.New("Agent env metadata is encrypted but no encryption key is configured")
+	}
+	gcm, err := newEnvCipher(key)
 	if err != nil {
 		return
 	}
-	envISO.Close()
-	output, err := runner.Run("mkisofs", "-o", envISO.Name(), envFile.Name())
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(metadata, encryptedMetadataPrefix))
+	if err != nil {
+		return
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted agent env metadata is too short")
+	}
+	res, err = gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
 	if err != nil {
-		out := string(output[:])
-		return "", errors.New(fmt.Sprintf("Failed to generate ISO for agent settings: %v\n%s", err, out))
+		return nil, fmt.Errorf("Failed to decrypt agent env metadata: %v", err)
 	}
-	// Cleanup temp dir but ignore the error. Failure to delete a temp file is not
-	// worth worrying about.
-	_ = os.RemoveAll(envDir)
-	return envISO.Name(), nil
+	return
 }
 
-// Creates agent env ISO, updates VM metadata, and attaches the ISO to VM
-func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
-	ctx.Logger.Infof("Creating agent env: %#v", env)
-	isoPath, err := createEnvISO(env, ctx.Runner)
+// AES-256-GCM with the key derived from the configured passphrase
+func newEnvCipher(key string) (cipher.AEAD, error) {
+	hash := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Name of the ISO file the agent env is uploaded as
+const envISOName = "agent-env.iso"
+
+// Volume label config drive consumers such as cloud-init look for
+const configDriveLabel = "config-2"
+
+func createEnvISO(config *cpi.Config, env *cpi.AgentEnv) (res *bytes.Reader, err error) {
+	format := ""
+	if config.Agent != nil {
+		format = config.Agent.EnvFormat
+	}
+
+	var img *iso.Image
+	switch format {
+	case "", cpi.BoshEnvFormat:
+		img, err = createBoshEnvImage(env)
+	case cpi.ConfigDriveEnvFormat:
+		img, err = createConfigDriveImage(env, "")
+	default:
+		err = fmt.Errorf("Unknown agent env format '%s'", format)
+	}
+	if err != nil {
+		return
+	}
+	return img.NewReader(), nil
+}
+
+func createBoshEnvImage(env *cpi.AgentEnv) (img *iso.Image, err error) {
+	json, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	// The agent looks for its settings in a file named "env" at the root of the ISO
+	img = iso.New("")
+	err = img.AddFile("env", json)
+	return
+}
+
+// Lays out the agent env the way an OpenStack config drive would. The user data
+// holds the agent settings along with the server name and, when a registry is
+// used, the registry endpoint, so agents using either source can find them.
+func createConfigDriveImage(env *cpi.AgentEnv, registryEndpoint string) (img *iso.Image, err error) {
+	envJson, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	userData := map[string]interface{}{}
+	err = json.Unmarshal(envJson, &userData)
+	if err != nil {
+		return
+	}
+	userData["server"] = map[string]interface{}{"name": env.VM.ID}
+	if registryEndpoint != "" {
+		userData["registry"] = map[string]interface{}{"endpoint": registryEndpoint}
+	}
+	userDataJson, err := json.Marshal(userData)
 	if err != nil {
 		return
 	}
-	defer os.Remove(isoPath)
 
+	metaData := map[string]interface{}{
+		"uuid":     env.VM.ID,
+		"name":     env.VM.Name,
+		"hostname": env.VM.Name,
+	}
+	metaDataJson, err := json.Marshal(metaData)
+	if err != nil {
+		return
+	}
+
+	img = iso.New(configDriveLabel)
+	err = img.AddFile("openstack/latest/user_data", userDataJson)
+	if err != nil {
+		return
+	}
+	err = img.AddFile("openstack/latest/meta_data.json", metaDataJson)
+	return
+}
+
+// Creates agent env ISO, updates VM metadata, and attaches the ISO to VM
+func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
 	// Store env JSON as metadata so it can be picked up by attach/detach disk
 	ctx.Logger.Info("Updating metadata for VM")
 	err = putAgentEnvMetadata(ctx, vmID, env)
@@ -105,6 +421,22 @@ func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error
 		return
 	}
 
+	return attachEnvISO(ctx, vmID, env)
+}
+
+// Creates agent env ISO and attaches it to VM in place of any previous one
+func attachEnvISO(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error) {
+	// The env holds the mbus and blobstore credentials, so only log what identifies it
+	ctx.Logger.Infof("Creating agent env for agent '%s' with disks: %#v", env.AgentID, env.Disks)
+	isoReader, err := createEnvISO(ctx.Config, env)
+	if err != nil {
+		return
+	}
+	return attachISO(ctx, vmID, isoReader)
+}
+
+// Attaches the ISO to VM in place of any previous one
+func attachISO(ctx *cpi.Context, vmID string, isoReader io.ReadSeeker) (err error) {
 	// Detach ISO first, but ignore any task error due to ISO already being detached
 	detachTask, err := ctx.Client.VMs.DetachISO(vmID)
 	if err != nil && !isTaskError(err) {
@@ -115,15 +447,8 @@ func updateAgentEnv(ctx *cpi.Context, vmID string, env *cpi.AgentEnv) (err error
 		return err
 	}
 
-	file, err := os.Open(isoPath)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-	isoName := filepath.Base(isoPath)
-
-	ctx.Logger.Infof("Attaching ISO with name: %s at path: %s", isoName, isoPath)
-	attachTask, err := ctx.Client.VMs.AttachISO(vmID, file, isoName)
+	ctx.Logger.Infof("Attaching ISO with name: %s", envISOName)
+	attachTask, err := ctx.Client.VMs.AttachISO(vmID, isoReader, envISOName)
 	if err != nil {
 		return
 	}
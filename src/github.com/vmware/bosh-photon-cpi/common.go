@@ -10,13 +10,33 @@
 package main
 
 import (
-	. "github.com/vmware/photon-controller-go-sdk/photon"
+	"fmt"
+
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
 )
 
+// Prefix for tags set by the CPI, keeps them apart from tags set outside of BOSH
+const boshTagPrefix = "bosh:"
+
 // Indicates whether or not an error is of type photon.TaskError
 func isTaskError(e error) bool {
-	if _, ok := e.(TaskError); ok {
+	if _, ok := e.(ec.TaskError); ok {
 		return true
 	}
 	return false
 }
+
+// Formats a BOSH metadata key and value as a Photon tag
+func boshTag(key string, value interface{}) string {
+	return boshTagPrefix + key + "=" + fmt.Sprint(value)
+}
+
+// Indicates whether or not tag is present in tags
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -14,26 +14,67 @@ import (
 	"github.com/vmware/bosh-photon-cpi/cmd"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	"github.com/vmware/photon-controller-go-sdk/photon"
+	"net/http"
 )
 
 type Context struct {
-	Client *photon.Client
-	Config *Config
-	Runner cmd.Runner
-	Logger logger.Logger
+	Client     *photon.Client
+	Config     *Config
+	Runner     cmd.Runner
+	Logger     logger.Logger
+	ApiVersion int
+
+	// Used for Photon endpoints the SDK doesn't wrap. http.DefaultClient is
+	// used when HTTPClient is nil. Tokens are shared with Client, so a token the
+	// SDK refreshes is picked up as well.
+	HTTPClient *http.Client
+	Tokens     *photon.TokenOptions
 }
 
 type Config struct {
-	Photon *PhotonConfig `json:"photon"`
-	Agent  *AgentConfig  `json:"agent"`
+	Photon          *PhotonConfig   `json:"photon"`
+	Agent           *AgentConfig    `json:"agent"`
+	StemcellFormats []string        `json:"stemcell_formats"`
+	AgentEnvService string          `json:"agent_env_service"`
+	Registry        *RegistryConfig `json:"registry"`
+
+	// Leave VMs that fail part way through create_vm in place for debugging
+	// instead of deleting them
+	KeepFailedVMs bool `json:"keep_failed_vms"`
+}
+
+// Supported values for Config.AgentEnvService. The file service, which is also
+// used when no service is configured, puts the agent env on an ISO attached to the VM.
+const (
+	FileAgentEnvService     = "file"
+	RegistryAgentEnvService = "registry"
+)
+
+type RegistryConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 type AgentConfig struct {
 	Mbus      string        `json:"mbus"`
 	NTP       []string      `json:"ntp"`
 	Blobstore BlobstoreSpec `json:"blobstore"`
+	EnvFormat string        `json:"env_format"`
+
+	// When set, the copy of the agent env kept in VM metadata is encrypted with this key
+	EnvEncryptionKey string `json:"env_encryption_key"`
 }
 
+// Supported values for AgentConfig.EnvFormat, which sets the layout of the agent
+// env ISO. The bosh format, also used when none is configured, holds a single
+// "env" file. The config-drive format follows the OpenStack config drive layout.
+const (
+	BoshEnvFormat        = "bosh"
+	ConfigDriveEnvFormat = "config-drive"
+)
+
 type PhotonConfig struct {
 	Target            string `json:"target"`
 	ProjectID         string `json:"project"`
@@ -42,6 +83,14 @@ type PhotonConfig struct {
 	Password          string `json:"password"`
 }
 
+const (
+	ApiVersion1 = 1
+	ApiVersion2 = 2
+
+	// Highest version of the CPI API understood by this CPI
+	ApiVersion = ApiVersion2
+)
+
 type ActionFn func(*Context, []interface{}) (interface{}, error)
 
 type BoshErrorType string
@@ -57,8 +106,28 @@ const (
 )
 
 type Request struct {
-	Method    string        `json:"method"`
-	Arguments []interface{} `json:"arguments"`
+	Method     string          `json:"method"`
+	Arguments  []interface{}   `json:"arguments"`
+	Context    *RequestContext `json:"context"`
+	ApiVersion int             `json:"api_version"`
+}
+
+// Context sent by the director with every request. For multi-CPI setups it
+// also carries the CPI properties, which may override the Photon config.
+type RequestContext struct {
+	DirectorUUID string                `json:"director_uuid"`
+	RequestID    string                `json:"request_id"`
+	Photon       *PhotonConfigOverride `json:"photon"`
+}
+
+// Photon settings that take precedence over PhotonConfig when set. IgnoreCertificate
+// is a pointer so that an explicit false can be told apart from a missing value.
+type PhotonConfigOverride struct {
+	Target            string `json:"target"`
+	ProjectID         string `json:"project"`
+	IgnoreCertificate *bool  `json:"ignore_cert"`
+	Username          string `json:"user"`
+	Password          string `json:"password"`
 }
 
 type Response struct {
@@ -116,6 +185,11 @@ func NewDiskNotAttachedError(diskId string, vmId string, retriable bool) error {
 	return &boshError{DiskNotAttachedError, retriable, fmt.Sprintf("Disk '%s' not attached to VM '%s'", diskId, vmId)}
 }
 
+type Info struct {
+	StemcellFormats []string `json:"stemcell_formats"`
+	ApiVersion      int      `json:"api_version"`
+}
+
 type Network struct {
 	Type            string                 `json:"type"`
 	IP              string                 `json:"ip"`
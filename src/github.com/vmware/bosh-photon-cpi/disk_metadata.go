@@ -0,0 +1,71 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+// BOSH metadata keys that are set as disk tags so a disk can be attributed to its
+// deployment and instance even after the VM is gone. Keys that change on every
+// attach, like attached_at, are left out since tags can't be removed.
+var diskTagKeys = []string{"director", "deployment", "job", "instance_id", "instance_index"}
+
+func SetDiskMetadata(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	metadata, ok := args[1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected argument where metadata should be")
+	}
+
+	ctx.Logger.Infof("SetDiskMetadata with disk_cid: '%s', metadata: '%v'", diskCID, metadata)
+
+	disk, err := ensureDiskExists(ctx, diskCID)
+	if err != nil {
+		return
+	}
+
+	for _, key := range diskTagKeys {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		tag := boshTag(key, value)
+		if hasTag(disk.Tags, tag) {
+			continue
+		}
+
+		ctx.Logger.Infof("Setting tag '%s' on disk", tag)
+		task, err := setDiskTag(ctx, diskCID, tag)
+		if err == errPhotonEndpointUnsupported {
+			// Director carries on without disk metadata
+			return nil, cpi.NewBoshError(cpi.NotImplementedError, false,
+				"Photon Controller does not support tagging disk '%s'", diskCID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ctx.Logger.Infof("Waiting on task: %#v", task)
+		_, err = ctx.Client.Tasks.Wait(task.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
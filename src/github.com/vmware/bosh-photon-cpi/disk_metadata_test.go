@@ -0,0 +1,176 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+var _ = Describe("Disk metadata", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
+			Logger: logger.New(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("SetDiskMetadata", func() {
+		It("sets tags that are not already on the disk", func() {
+			disk := &ec.PersistentDisk{
+				ID:   "fake-disk-id",
+				Tags: []string{"bosh:director=fake-director"},
+			}
+			tagTask := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+			tagCompletedTask := &ec.Task{Operation: "SET_TAG", State: "COMPLETED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+
+			sentTags := []string{}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/tags",
+				func(req *http.Request) (*http.Response, error) {
+					tag := diskTag{}
+					json.NewDecoder(req.Body).Decode(&tag)
+					sentTags = append(sentTags, tag.Tag)
+					return CreateResponder(200, ToJson(tagTask))(req)
+				})
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+tagTask.ID,
+				CreateResponder(200, ToJson(tagCompletedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"set_disk_metadata": SetDiskMetadata,
+			}
+			metadata := map[string]interface{}{
+				"director":       "fake-director",
+				"deployment":     "fake-deployment",
+				"job":            "fake-job",
+				"instance_id":    "fake-instance-id",
+				"instance_index": "0",
+				"attached_at":    "2016-01-01T00:00:00Z",
+			}
+			args := []interface{}{"fake-disk-id", metadata}
+			res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+
+			Expect(sentTags).Should(Equal([]string{
+				"bosh:deployment=fake-deployment",
+				"bosh:job=fake-job",
+				"bosh:instance_id=fake-instance-id",
+				"bosh:instance_index=0",
+			}))
+		})
+		It("returns NotImplemented when Photon can't tag disks", func() {
+			disk := &ec.PersistentDisk{ID: "fake-disk-id"}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/tags",
+				CreateResponder(404, ""))
+
+			actions := map[string]cpi.ActionFn{
+				"set_disk_metadata": SetDiskMetadata,
+			}
+			args := []interface{}{"fake-disk-id", map[string]interface{}{"job": "fake-job"}}
+			res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.NotImplementedError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns an error when disk not found", func() {
+			apiError := ec.ApiError{HttpStatusCode: 404, Code: "DiskNotFound", Message: ""}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+"fake-disk-id",
+				CreateResponder(404, ToJson(apiError)))
+
+			actions := map[string]cpi.ActionFn{
+				"set_disk_metadata": SetDiskMetadata,
+			}
+			args := []interface{}{"fake-disk-id", map[string]interface{}{"job": "fake-job"}}
+			res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.DiskNotFoundError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given no arguments", func() {
+			actions := map[string]cpi.ActionFn{
+				"set_disk_metadata": SetDiskMetadata,
+			}
+			args := []interface{}{}
+			res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given an invalid argument", func() {
+			actions := map[string]cpi.ActionFn{
+				"set_disk_metadata": SetDiskMetadata,
+			}
+			args := []interface{}{"fake-disk-id", 5}
+			res, err := GetResponse(dispatch(ctx, actions, "set_disk_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+})
@@ -46,9 +46,14 @@ func CreateDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		"CreateDisk with disk_size: '%v' (rounded to '%v' GiB), cloud_properties: '%v', flavor: '%s', vm_cid: '%s'",
 		disk_size, size, cloudProps, flavor, vmCID)
 
+	err = validateFlavor(ctx, persistentDiskKind, flavor)
+	if err != nil {
+		return
+	}
+
 	diskSpec := &ec.DiskCreateSpec{
 		Flavor:     flavor,
-		Kind:       "persistent-disk",
+		Kind:       persistentDiskKind,
 		CapacityGB: size,
 		Name:       "disk-for-vm-" + vmCID,
 		Affinities: []ec.LocalitySpec{ec.LocalitySpec{Kind: "vm", ID: vmCID}},
@@ -78,12 +83,12 @@ func DeleteDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 
 	ctx.Logger.Infof("DeleteDisk with disk_cid: '%s'", diskCID)
 
-	_, err = ensureDiskExists(ctx, diskCID)
+	disk, err := ensureDiskExists(ctx, diskCID)
 	if err != nil {
 		return
 	}
 
-	ctx.Logger.Info("Deleting disk")
+	ctx.Logger.Infof("Deleting disk '%s' with tags: '%v'", disk.Name, disk.Tags)
 	task, err := ctx.Client.Disks.Delete(diskCID)
 	if err != nil {
 		return
@@ -116,30 +121,69 @@ func GetDisks(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 	}
 	vmCID, ok := args[0].(string)
 	if !ok {
-		return nil, errors.New("Unexpected argument where vim_cid should be")
+		return nil, errors.New("Unexpected argument where vm_cid should be")
 	}
 
 	ctx.Logger.Infof("GetDisks with vm_cid: '%s'", vmCID)
 
-	_, err = ensureVMExists(ctx, vmCID)
+	vm, err := ensureVMExists(ctx, vmCID)
+	if err != nil {
+		return
+	}
+
+	return persistentDiskIDs(vm), nil
+}
+
+func ResizeDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	newSize, ok := args[1].(float64)
+	if !ok {
+		return nil, errors.New("Unexpected argument where new_size should be")
+	}
+	size := toGB(newSize)
+
+	ctx.Logger.Infof(
+		"ResizeDisk with disk_cid: '%s', new_size: '%v' (rounded to '%v' GiB)", diskCID, newSize, size)
+
+	disk, err := ensureDiskExists(ctx, diskCID)
 	if err != nil {
 		return
 	}
 
-	disks, err := ctx.Client.Projects.GetDisks(ctx.Config.Photon.ProjectID, nil)
+	if size < disk.CapacityGB {
+		// Director falls back to creating a new disk and copying the data
+		return nil, cpi.NewBoshError(
+			cpi.NotSupportedError, false,
+			"Cannot shrink disk '%s' from %d GiB to %d GiB", diskCID, disk.CapacityGB, size)
+	}
+	if size == disk.CapacityGB {
+		ctx.Logger.Infof("Disk '%s' is already %d GiB, skipping resize", diskCID, size)
+		return nil, nil
+	}
+
+	ctx.Logger.Info("Resizing disk")
+	task, err := resizeDisk(ctx, diskCID, size)
+	if err == errPhotonEndpointUnsupported {
+		// Director falls back to creating a new disk and copying the data
+		return nil, cpi.NewBoshError(
+			cpi.NotSupportedError, false, "Photon Controller does not support resizing disk '%s'", diskCID)
+	}
 	if err != nil {
 		return
 	}
 
-	res := []string{}
-	for _, disk := range disks.Items {
-		for _, vm := range disk.VMs {
-			if vm == vmCID {
-				res = append(res, disk.ID)
-			}
-		}
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	task, err = ctx.Client.Tasks.Wait(task.ID)
+	if err != nil {
+		return
 	}
-	return res, nil
+	return nil, nil
 }
 
 func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
@@ -157,6 +201,11 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 
 	ctx.Logger.Infof("AttachDisk with vm_cid: '%s', disk_cid: '%s'", vmCID, diskCID)
 
+	agentEnvService, err := newAgentEnvService(ctx)
+	if err != nil {
+		return
+	}
+
 	_, err = ensureVMExists(ctx, vmCID)
 	if err != nil {
 		return
@@ -167,6 +216,14 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		return
 	}
 
+	// Read the agent env before attaching, so a VM whose agent env can't be
+	// updated is left untouched
+	ctx.Logger.Info("Getting agent env for VM")
+	env, err := agentEnvService.Get(vmCID)
+	if err != nil {
+		return
+	}
+
 	ctx.Logger.Info("Attaching disk")
 	op := &ec.VmDiskOperation{DiskID: diskCID}
 	task, err := ctx.Client.VMs.AttachDisk(vmCID, op)
@@ -180,12 +237,7 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		return
 	}
 
-	ctx.Logger.Info("Getting metadata for VM")
-	// Get agent env config from VM metadata and update disk ID
-	env, err := getAgentEnvMetadata(ctx, vmCID)
-	if err != nil {
-		return
-	}
+	// Update disk ID in agent env config
 	if env.Disks == nil {
 		env.Disks = map[string]interface{}{}
 	}
@@ -197,18 +249,18 @@ func AttachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	if !ok {
 		return nil, errors.New("Unexpected type found in VM metadata")
 	}
-	// Agent expects a mapping of disk_cid to the ID that gets used by the agent
-	// to resolve the path to the device. In our case, it is the same ID as disk_cid.
-	diskMap[diskCID] = map[string]interface{}{
-		"id":   diskCID,
-		"path": "",
-	}
+	diskHint := getDiskHint(diskCID)
+	diskMap[diskCID] = diskHint
 
-	err = updateAgentEnv(ctx, vmCID, env)
+	err = agentEnvService.Update(vmCID, env)
 	if err != nil {
 		return
 	}
 
+	// CPI API v2 returns the disk hint so the director can pass it on to the agent
+	if ctx.ApiVersion >= cpi.ApiVersion2 {
+		return diskHint, nil
+	}
 	return nil, nil
 }
 
@@ -227,6 +279,11 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 
 	ctx.Logger.Infof("DetachDisk with vm_cid: '%s', disk_cid: '%s'", vmCID, diskCID)
 
+	agentEnvService, err := newAgentEnvService(ctx)
+	if err != nil {
+		return
+	}
+
 	_, err = ensureVMExists(ctx, vmCID)
 	if err != nil {
 		return
@@ -242,6 +299,12 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		return
 	}
 
+	ctx.Logger.Info("Getting agent env for VM")
+	env, err := agentEnvService.Get(vmCID)
+	if err != nil {
+		return
+	}
+
 	ctx.Logger.Info("Detaching disk")
 	op := &ec.VmDiskOperation{DiskID: diskCID}
 	task, err := ctx.Client.VMs.DetachDisk(vmCID, op)
@@ -255,18 +318,13 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 		return
 	}
 
-	// Get agent env config from VM metadata and remove disk ID
-	ctx.Logger.Info("Getting metadata for VM")
-	env, err := getAgentEnvMetadata(ctx, vmCID)
-	if err != nil {
-		return
-	}
+	// Remove disk ID from agent env config
 	persistent := "persistent"
 	if diskMap, ok := env.Disks[persistent].(map[string]interface{}); ok {
 		delete(diskMap, diskCID)
 	}
 
-	err = updateAgentEnv(ctx, vmCID, env)
+	err = agentEnvService.Update(vmCID, env)
 	if err != nil {
 		return
 	}
@@ -274,6 +332,17 @@ func DetachDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err e
 	return nil, nil
 }
 
+// Returns the IDs of the persistent disks attached to the VM, in attach order
+func persistentDiskIDs(vm *ec.VM) []string {
+	res := []string{}
+	for _, disk := range vm.AttachedDisks {
+		if disk.Kind == persistentDiskKind {
+			res = append(res, disk.ID)
+		}
+	}
+	return res
+}
+
 func toGB(mb float64) int {
 	return int(math.Ceil(mb / 1000.0))
 }
@@ -328,3 +397,15 @@ func ensureDiskAttachedToVM(ctx *cpi.Context, disk *ec.PersistentDisk, vmCID str
 	err = cpi.NewDiskNotAttachedError(disk.ID, vmCID, false)
 	return
 }
+
+// Builds the hint the agent uses to find an attached disk. The agent expects a
+// mapping of disk_cid to the ID that gets used to resolve the path to the device,
+// which in our case is the disk_cid itself. Photon does not report the SCSI unit
+// a disk lands on, and the attach order stops matching it as soon as a disk is
+// detached, so no device path or volume ID is guessed here.
+func getDiskHint(diskCID string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   diskCID,
+		"path": "",
+	}
+}
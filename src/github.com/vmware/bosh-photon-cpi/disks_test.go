@@ -83,6 +83,12 @@ var _ = Describe("Disk", func() {
 				"GET",
 				server.URL+rootUrl+"/vms/"+"fake-vm-id",
 				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=persistent-disk",
+				CreateResponder(200, ToJson(&ec.FlavorList{Items: []ec.Flavor{
+					ec.Flavor{Name: "disk-flavor", Kind: "persistent-disk"},
+				}})))
 			RegisterResponder(
 				"POST",
 				server.URL+rootUrl+"/projects/"+projID+"/disks",
@@ -381,27 +387,22 @@ var _ = Describe("Disk", func() {
 	})
 
 	Describe("GetDisks", func() {
-		It("returns a list of VM IDs that a disk is attached to", func() {
-			list := &ec.DiskList{
-				[]ec.PersistentDisk{
-					ec.PersistentDisk{ID: "disk-1", VMs: []string{"vm-1", "vm-2"}},
-					ec.PersistentDisk{ID: "disk-2", VMs: []string{"vm-2", "vm-3"}},
-					ec.PersistentDisk{ID: "disk-3", VMs: []string{"vm-4", "vm-5"}},
-					ec.PersistentDisk{ID: "disk-4", VMs: []string{"vm-2", "vm-4"}},
+		It("returns a list of persistent disks attached to the VM", func() {
+			vm := &ec.VM{
+				ID: "vm-2",
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{ID: "boot-disk", Kind: "ephemeral-disk", BootDisk: true},
+					ec.AttachedDisk{ID: "disk-1", Kind: "persistent-disk"},
+					ec.AttachedDisk{ID: "eph-disk", Kind: "ephemeral-disk"},
+					ec.AttachedDisk{ID: "disk-2", Kind: "persistent-disk"},
 				},
 			}
-			// Disks on vm-2
-			matchedList := []interface{}{"disk-4", "disk-2", "disk-1"}
-			vm := &ec.VM{ID: "vm-2"}
+			matchedList := []interface{}{"disk-1", "disk-2"}
 
 			RegisterResponder(
 				"GET",
 				server.URL+rootUrl+"/vms/"+"vm-2",
 				CreateResponder(200, ToJson(vm)))
-			RegisterResponder(
-				"GET",
-				server.URL+rootUrl+"/projects/"+projID+"/disks",
-				CreateResponder(200, ToJson(list)))
 
 			actions := map[string]cpi.ActionFn{
 				"get_disks": GetDisks,
@@ -409,33 +410,29 @@ var _ = Describe("Disk", func() {
 			args := []interface{}{"vm-2"}
 			res, err := GetResponse(dispatch(ctx, actions, "get_disks", args))
 
-			Expect(res.Result).Should(ConsistOf(matchedList))
+			Expect(res.Result).Should(Equal(matchedList))
 			Expect(res.Error).Should(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
 		It("returns an empty list if no disks are attached to VM", func() {
-			list := &ec.DiskList{
-				[]ec.PersistentDisk{
-					ec.PersistentDisk{ID: "disk-1", VMs: []string{"other-vm"}},
+			vm := &ec.VM{
+				ID: "vm-3",
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{ID: "boot-disk", Kind: "ephemeral-disk", BootDisk: true},
 				},
 			}
 			matchedList := []interface{}{}
-			vm := &ec.VM{ID: "vm-2"}
 
 			RegisterResponder(
 				"GET",
-				server.URL+rootUrl+"/vms/"+"vm-2",
+				server.URL+rootUrl+"/vms/"+"vm-3",
 				CreateResponder(200, ToJson(vm)))
-			RegisterResponder(
-				"GET",
-				server.URL+rootUrl+"/projects/"+projID+"/disks",
-				CreateResponder(200, ToJson(list)))
 
 			actions := map[string]cpi.ActionFn{
 				"get_disks": GetDisks,
 			}
-			args := []interface{}{"vm-2"}
+			args := []interface{}{"vm-3"}
 			res, err := GetResponse(dispatch(ctx, actions, "get_disks", args))
 
 			Expect(res.Result).Should(ConsistOf(matchedList))
@@ -444,17 +441,17 @@ var _ = Describe("Disk", func() {
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
 		It("returns an error when server returns error", func() {
-			list := &ec.DiskList{[]ec.PersistentDisk{}}
+			vm := &ec.VM{ID: "vm-4"}
 
 			RegisterResponder(
 				"GET",
-				server.URL+rootUrl+"/projects/"+projID+"/disks",
-				CreateResponder(500, ToJson(list)))
+				server.URL+rootUrl+"/vms/"+"vm-4",
+				CreateResponder(500, ToJson(vm)))
 
 			actions := map[string]cpi.ActionFn{
 				"get_disks": GetDisks,
 			}
-			args := []interface{}{"vm-2"}
+			args := []interface{}{"vm-4"}
 			res, err := GetResponse(dispatch(ctx, actions, "get_disks", args))
 
 			Expect(res.Result).Should(BeNil())
@@ -505,6 +502,114 @@ var _ = Describe("Disk", func() {
 			})
 		})
 	})
+	Describe("ResizeDisk", func() {
+		It("returns nothing when resize succeeds", func() {
+			disk := &ec.PersistentDisk{ID: "fake-disk-id", CapacityGB: 2}
+			resizeTask := &ec.Task{Operation: "RESIZE_DISK", State: "QUEUED", ID: "fake-resize-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+			completedTask := &ec.Task{Operation: "RESIZE_DISK", State: "COMPLETED", ID: "fake-resize-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/resize",
+				CreateResponder(200, ToJson(resizeTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+resizeTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"resize_disk": ResizeDisk,
+			}
+			args := []interface{}{"fake-disk-id", 4096.0}
+			res, err := GetResponse(dispatch(ctx, actions, "resize_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns NotSupported when Photon can't resize disks", func() {
+			disk := &ec.PersistentDisk{ID: "fake-disk-id", CapacityGB: 2}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/resize",
+				CreateResponder(404, ""))
+
+			actions := map[string]cpi.ActionFn{
+				"resize_disk": ResizeDisk,
+			}
+			args := []interface{}{"fake-disk-id", 4096.0}
+			res, err := GetResponse(dispatch(ctx, actions, "resize_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.NotSupportedError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns NotSupported when shrinking a disk", func() {
+			disk := &ec.PersistentDisk{ID: "fake-big-disk-id", CapacityGB: 10}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+
+			actions := map[string]cpi.ActionFn{
+				"resize_disk": ResizeDisk,
+			}
+			args := []interface{}{"fake-big-disk-id", 1024.0}
+			res, err := GetResponse(dispatch(ctx, actions, "resize_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.NotSupportedError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns an error when disk not found", func() {
+			apiError := ec.ApiError{HttpStatusCode: 404, Code: "DiskNotFound", Message: ""}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+"fake-missing-disk-id",
+				CreateResponder(404, ToJson(apiError)))
+
+			actions := map[string]cpi.ActionFn{
+				"resize_disk": ResizeDisk,
+			}
+			args := []interface{}{"fake-missing-disk-id", 4096.0}
+			res, err := GetResponse(dispatch(ctx, actions, "resize_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.DiskNotFoundError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given an invalid argument", func() {
+			actions := map[string]cpi.ActionFn{
+				"resize_disk": ResizeDisk,
+			}
+			args := []interface{}{"fake-disk-id", "big"}
+			res, err := GetResponse(dispatch(ctx, actions, "resize_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+
 	Describe("AttachDisk", func() {
 		It("returns nothing when attach succeeds", func() {
 			attachTask := &ec.Task{Operation: "ATTACH_DISK", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
@@ -577,6 +682,78 @@ var _ = Describe("Disk", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
+		It("returns a disk hint when attach succeeds with API version 2", func() {
+			attachTask := &ec.Task{Operation: "ATTACH_DISK", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+			completedTask := &ec.Task{Operation: "ATTACH_DISK", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+
+			detachIsoTask := &ec.Task{Operation: "DETACH_ISO", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+			detachCompletedTask := &ec.Task{Operation: "DETACH_ISO", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-disk-id"}}
+
+			isoTask := &ec.Task{Operation: "ATTACH_ISO", State: "QUEUED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			isoCompletedTask := &ec.Task{Operation: "ATTACH_ISO", State: "COMPLETED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			env := &cpi.AgentEnv{AgentID: "agent-id", VM: cpi.VMSpec{ID: "fake-vm-id", Name: "fake-vm"}}
+			vm := &ec.VM{
+				ID:       "fake-vm-id",
+				Metadata: map[string]string{"bosh-cpi": GetEnvMetadata(env)},
+			}
+			disk := &ec.PersistentDisk{ID: "fake-disk-id"}
+			metadataTask := &ec.Task{State: "COMPLETED"}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+"fake-vm-id",
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+"fake-disk-id",
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/attach_disk",
+				CreateResponder(200, ToJson(attachTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/attach_iso",
+				CreateResponder(200, ToJson(isoTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/detach_iso",
+				CreateResponder(200, ToJson(detachIsoTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/set_metadata",
+				CreateResponder(200, ToJson(metadataTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/fake-vm-id",
+				CreateResponder(200, ToJson(vm)))
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+attachTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+isoTask.ID,
+				CreateResponder(200, ToJson(isoCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+detachIsoTask.ID,
+				CreateResponder(200, ToJson(detachCompletedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"attach_disk": AttachDisk,
+			}
+			args := []interface{}{"fake-vm-id", "fake-disk-id"}
+			ctx.ApiVersion = cpi.ApiVersion2
+			res, err := GetResponse(dispatch(ctx, actions, "attach_disk", args))
+
+			Expect(res.Result).Should(Equal(map[string]interface{}{"id": "fake-disk-id", "path": ""}))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
 		It("returns an error when VM not found", func() {
 			apiError := ec.ApiError{HttpStatusCode: 404, Code: "VMNotFound", Message: ""}
 
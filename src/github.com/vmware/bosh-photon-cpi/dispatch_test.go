@@ -92,6 +92,12 @@ var _ = Describe("Dispatch", func() {
 		Expect(res.Error.Type).Should(Equal(cpi.NotSupportedError))
 		Expect(err).ShouldNot(HaveOccurred())
 	})
+	It("negotiates the CPI API version", func() {
+		Expect(negotiateApiVersion(0)).Should(Equal(cpi.ApiVersion1))
+		Expect(negotiateApiVersion(1)).Should(Equal(cpi.ApiVersion1))
+		Expect(negotiateApiVersion(2)).Should(Equal(cpi.ApiVersion2))
+		Expect(negotiateApiVersion(cpi.ApiVersion + 1)).Should(Equal(cpi.ApiVersion))
+	})
 	It("loads JSON config correctly", func() {
 		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
 		if err != nil {
@@ -101,11 +107,50 @@ var _ = Describe("Dispatch", func() {
 		jsonConfig := `{"photon":{"Target":"http://none:123"}}`
 		configFile.WriteString(jsonConfig)
 
-		context, err := loadConfig(configPath)
+		context, err := loadConfig(configPath, nil)
 		expectedURL := fmt.Sprintf("http://%s:%d", "none", 123)
 		Expect(context.Client.Endpoint).Should(Equal(expectedURL))
 		Expect(err).Should(BeNil())
 	})
+	It("overrides JSON config with the request context", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		jsonConfig := `{"photon":{"Target":"http://none:123","project":"fake-project-id","ignore_cert":true}}`
+		configFile.WriteString(jsonConfig)
+
+		ignoreCert := false
+		reqContext := &cpi.RequestContext{
+			DirectorUUID: "fake-director-uuid",
+			Photon: &cpi.PhotonConfigOverride{
+				Target:            "http://other:456",
+				ProjectID:         "other-project-id",
+				IgnoreCertificate: &ignoreCert,
+			},
+		}
+		context, err := loadConfig(configPath, reqContext)
+		Expect(err).Should(BeNil())
+		Expect(context.Client.Endpoint).Should(Equal("http://other:456"))
+		Expect(context.Config.Photon.ProjectID).Should(Equal("other-project-id"))
+		Expect(context.Config.Photon.IgnoreCertificate).Should(BeFalse())
+	})
+	It("keeps JSON config when the request context has no photon settings", func() {
+		configFile, err := ioutil.TempFile("", "bosh-photon-cpi-config")
+		if err != nil {
+			panic(err)
+		}
+		configPath = configFile.Name()
+		jsonConfig := `{"photon":{"Target":"http://none:123","project":"fake-project-id"}}`
+		configFile.WriteString(jsonConfig)
+
+		reqContext := &cpi.RequestContext{DirectorUUID: "fake-director-uuid"}
+		context, err := loadConfig(configPath, reqContext)
+		Expect(err).Should(BeNil())
+		Expect(context.Client.Endpoint).Should(Equal("http://none:123"))
+		Expect(context.Config.Photon.ProjectID).Should(Equal("fake-project-id"))
+	})
 })
 
 func createVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
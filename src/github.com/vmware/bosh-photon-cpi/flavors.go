@@ -0,0 +1,209 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+// Photon uses the same kinds for flavors and for the disks created from them
+const (
+	vmFlavorKind       = "vm"
+	ephemeralDiskKind  = "ephemeral-disk"
+	persistentDiskKind = "persistent-disk"
+
+	vmCPUCostKey         = "vm.cpu"
+	vmMemoryCostKey      = "vm.memory"
+	ephemeralDiskCostKey = "ephemeral-disk.cost"
+)
+
+// Candidate VM flavor with its capacity read from the flavor cost
+type vmFlavorSize struct {
+	name     string
+	cpu      float64
+	memoryMB float64
+}
+
+// Sorts VM flavors by memory, then CPUs, then name
+type vmFlavorSizes []vmFlavorSize
+
+func (s vmFlavorSizes) Len() int      { return len(s) }
+func (s vmFlavorSizes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s vmFlavorSizes) Less(i, j int) bool {
+	if s[i].memoryMB != s[j].memoryMB {
+		return s[i].memoryMB < s[j].memoryMB
+	}
+	if s[i].cpu != s[j].cpu {
+		return s[i].cpu < s[j].cpu
+	}
+	return s[i].name < s[j].name
+}
+
+func CalculateVmCloudProperties(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 1 {
+		return nil, errors.New("Expected at least 1 argument")
+	}
+	requirements, ok := args[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected argument where vm_resources should be")
+	}
+	cpu, ok := requirements["cpu"].(float64)
+	if !ok {
+		return nil, errors.New("Unexpected value for vm_resources:cpu")
+	}
+	ram, ok := requirements["ram"].(float64)
+	if !ok {
+		return nil, errors.New("Unexpected value for vm_resources:ram")
+	}
+	ephemeralDiskSize, ok := requirements["ephemeral_disk_size"].(float64)
+	if !ok {
+		return nil, errors.New("Unexpected value for vm_resources:ephemeral_disk_size")
+	}
+
+	ctx.Logger.Infof(
+		"CalculateVmCloudProperties with cpu: '%v', ram: '%v', ephemeral_disk_size: '%v'",
+		cpu, ram, ephemeralDiskSize)
+
+	vmFlavors, err := getFlavors(ctx, vmFlavorKind)
+	if err != nil {
+		return
+	}
+	vmFlavor, err := smallestVMFlavor(vmFlavors, cpu, ram)
+	if err != nil {
+		return
+	}
+
+	diskFlavors, err := getFlavors(ctx, ephemeralDiskKind)
+	if err != nil {
+		return
+	}
+	diskFlavor, err := cheapestDiskFlavor(diskFlavors)
+	if err != nil {
+		return
+	}
+
+	diskSizeGB := toGB(ephemeralDiskSize)
+	if diskSizeGB < 1 {
+		diskSizeGB = 1
+	}
+
+	return map[string]interface{}{
+		VMFlavorElement:             vmFlavor,
+		DiskFlavorElement:           diskFlavor,
+		VMAttachedDiskSizeGBElement: diskSizeGB,
+	}, nil
+}
+
+// Gets all usable flavors of the given kind
+func getFlavors(ctx *cpi.Context, kind string) (flavors []ec.Flavor, err error) {
+	ctx.Logger.Infof("Getting flavors of kind '%s'", kind)
+	list, err := ctx.Client.Flavors.GetAll(&ec.FlavorGetOptions{Kind: kind})
+	if err != nil {
+		return
+	}
+	for _, flavor := range list.Items {
+		// Flavors that are being deleted can't be used for new VMs or disks
+		if flavor.Kind == kind && flavor.State != "PENDING_DELETE" {
+			flavors = append(flavors, flavor)
+		}
+	}
+	return
+}
+
+// Checks that a usable flavor of the given kind exists, so a typo in cloud
+// properties fails right away instead of deep inside a Photon task
+func validateFlavor(ctx *cpi.Context, kind string, name string) (err error) {
+	flavors, err := getFlavors(ctx, kind)
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for _, flavor := range flavors {
+		if flavor.Name == name {
+			return nil
+		}
+		names = append(names, flavor.Name)
+	}
+	sort.Strings(names)
+	return cpi.NewBoshError(cpi.CloudError, false,
+		"No %s flavor named '%s' found, available %s flavors: [%s]", kind, name, kind, strings.Join(names, ", "))
+}
+
+// Picks the VM flavor with the least memory, then the fewest CPUs, that fits
+// the requested number of CPUs and MiB of memory.
+func smallestVMFlavor(flavors []ec.Flavor, cpu float64, ramMB float64) (name string, err error) {
+	candidates := []vmFlavorSize{}
+	for _, flavor := range flavors {
+		size := vmFlavorSize{name: flavor.Name}
+		for _, item := range flavor.Cost {
+			switch item.Key {
+			case vmCPUCostKey:
+				size.cpu = item.Value
+			case vmMemoryCostKey:
+				size.memoryMB = toMB(item.Value, item.Unit)
+			}
+		}
+		if size.cpu >= cpu && size.memoryMB >= ramMB {
+			candidates = append(candidates, size)
+		}
+	}
+	if len(candidates) == 0 {
+		err = cpi.NewBoshError(
+			cpi.CloudError, false, "No vm flavor found with at least %v CPUs and %v MiB of memory", cpu, ramMB)
+		return
+	}
+
+	sort.Sort(vmFlavorSizes(candidates))
+	return candidates[0].name, nil
+}
+
+// Ephemeral disk flavors don't determine the disk size, so pick the one with
+// the lowest cost.
+func cheapestDiskFlavor(flavors []ec.Flavor) (name string, err error) {
+	if len(flavors) == 0 {
+		err = cpi.NewBoshError(cpi.CloudError, false, "No %s flavor found", ephemeralDiskKind)
+		return
+	}
+
+	cost := func(flavor ec.Flavor) float64 {
+		for _, item := range flavor.Cost {
+			if item.Key == ephemeralDiskCostKey {
+				return item.Value
+			}
+		}
+		return 0
+	}
+	cheapest := flavors[0]
+	for _, flavor := range flavors[1:] {
+		if cost(flavor) < cost(cheapest) || (cost(flavor) == cost(cheapest) && flavor.Name < cheapest.Name) {
+			cheapest = flavor
+		}
+	}
+	return cheapest.Name, nil
+}
+
+// Converts a quota line item value to MiB
+func toMB(value float64, unit string) float64 {
+	switch unit {
+	case "GB":
+		return value * 1024
+	case "KB":
+		return value / 1024
+	case "B":
+		return value / (1024 * 1024)
+	default:
+		return value
+	}
+}
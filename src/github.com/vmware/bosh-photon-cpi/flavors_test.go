@@ -0,0 +1,175 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+var _ = Describe("Flavors", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
+			Logger: logger.New(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("CalculateVmCloudProperties", func() {
+		var (
+			vmFlavors   *ec.FlavorList
+			diskFlavors *ec.FlavorList
+		)
+
+		BeforeEach(func() {
+			vmFlavors = &ec.FlavorList{Items: []ec.Flavor{
+				ec.Flavor{Name: "core-100", Kind: "vm", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "vm.cpu", Value: 1, Unit: "COUNT"},
+					ec.QuotaLineItem{Key: "vm.memory", Value: 2, Unit: "GB"},
+				}},
+				ec.Flavor{Name: "core-200", Kind: "vm", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "vm.cpu", Value: 2, Unit: "COUNT"},
+					ec.QuotaLineItem{Key: "vm.memory", Value: 4, Unit: "GB"},
+				}},
+				ec.Flavor{Name: "core-300", Kind: "vm", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "vm.cpu", Value: 4, Unit: "COUNT"},
+					ec.QuotaLineItem{Key: "vm.memory", Value: 4, Unit: "GB"},
+				}},
+				ec.Flavor{Name: "core-deleted", Kind: "vm", State: "PENDING_DELETE", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "vm.cpu", Value: 2, Unit: "COUNT"},
+					ec.QuotaLineItem{Key: "vm.memory", Value: 3072, Unit: "MB"},
+				}},
+			}}
+			diskFlavors = &ec.FlavorList{Items: []ec.Flavor{
+				ec.Flavor{Name: "disk-ssd", Kind: "ephemeral-disk", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "ephemeral-disk.cost", Value: 2, Unit: "COUNT"},
+				}},
+				ec.Flavor{Name: "disk-hdd", Kind: "ephemeral-disk", Cost: []ec.QuotaLineItem{
+					ec.QuotaLineItem{Key: "ephemeral-disk.cost", Value: 1, Unit: "COUNT"},
+				}},
+			}}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=vm",
+				CreateResponder(200, ToJson(vmFlavors)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=ephemeral-disk",
+				CreateResponder(200, ToJson(diskFlavors)))
+		})
+
+		It("returns the smallest fitting flavors", func() {
+			actions := map[string]cpi.ActionFn{
+				"calculate_vm_cloud_properties": CalculateVmCloudProperties,
+			}
+			args := []interface{}{map[string]interface{}{
+				"cpu":                 2.0,
+				"ram":                 3072.0,
+				"ephemeral_disk_size": 10240.0,
+			}}
+			res, err := GetResponse(dispatch(ctx, actions, "calculate_vm_cloud_properties", args))
+
+			Expect(res.Result).Should(Equal(map[string]interface{}{
+				"vm_flavor":                "core-200",
+				"disk_flavor":              "disk-hdd",
+				"vm_attached_disk_size_gb": 11.0,
+			}))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns an error when no flavor is large enough", func() {
+			actions := map[string]cpi.ActionFn{
+				"calculate_vm_cloud_properties": CalculateVmCloudProperties,
+			}
+			args := []interface{}{map[string]interface{}{
+				"cpu":                 8.0,
+				"ram":                 1024.0,
+				"ephemeral_disk_size": 1024.0,
+			}}
+			res, err := GetResponse(dispatch(ctx, actions, "calculate_vm_cloud_properties", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given an invalid argument", func() {
+			actions := map[string]cpi.ActionFn{
+				"calculate_vm_cloud_properties": CalculateVmCloudProperties,
+			}
+			args := []interface{}{map[string]interface{}{"cpu": "two"}}
+			res, err := GetResponse(dispatch(ctx, actions, "calculate_vm_cloud_properties", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+
+	Describe("validateFlavor", func() {
+		BeforeEach(func() {
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=persistent-disk",
+				CreateResponder(200, ToJson(&ec.FlavorList{Items: []ec.Flavor{
+					ec.Flavor{Name: "disk-ssd", Kind: "persistent-disk"},
+					ec.Flavor{Name: "disk-hdd", Kind: "persistent-disk"},
+					ec.Flavor{Name: "disk-deleted", Kind: "persistent-disk", State: "PENDING_DELETE"},
+				}})))
+		})
+
+		It("accepts an existing flavor", func() {
+			err := validateFlavor(ctx, persistentDiskKind, "disk-ssd")
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+		It("returns an error naming the missing and available flavors", func() {
+			err := validateFlavor(ctx, persistentDiskKind, "disk-missing")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(cpi.BoshError).Type()).Should(Equal(cpi.CloudError))
+			Expect(err.Error()).Should(ContainSubstring("disk-missing"))
+			Expect(err.Error()).Should(ContainSubstring("disk-hdd, disk-ssd"))
+		})
+		It("treats a flavor pending delete as missing", func() {
+			err := validateFlavor(ctx, persistentDiskKind, "disk-deleted")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(HaveSuffix("[disk-hdd, disk-ssd]"))
+		})
+	})
+})
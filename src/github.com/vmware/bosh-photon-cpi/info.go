@@ -0,0 +1,28 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+// Stemcell formats advertised when none are given in the CPI config
+var defaultStemcellFormats = []string{"vsphere-ova", "vsphere-ovf"}
+
+func Info(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	formats := defaultStemcellFormats
+	if ctx.Config != nil && len(ctx.Config.StemcellFormats) > 0 {
+		formats = ctx.Config.StemcellFormats
+	}
+
+	ctx.Logger.Infof("Info with stemcell_formats: '%v', api_version: '%d'", formats, cpi.ApiVersion)
+
+	return &cpi.Info{StemcellFormats: formats, ApiVersion: cpi.ApiVersion}, nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+)
+
+var _ = Describe("Info", func() {
+	var (
+		ctx *cpi.Context
+	)
+
+	BeforeEach(func() {
+		ctx = &cpi.Context{
+			Config: &cpi.Config{},
+			Logger: logger.New(),
+		}
+	})
+
+	It("returns the default stemcell formats and API version", func() {
+		actions := map[string]cpi.ActionFn{
+			"info": Info,
+		}
+		res, err := GetResponse(dispatch(ctx, actions, "info", []interface{}{}))
+
+		Expect(res.Result).Should(Equal(map[string]interface{}{
+			"stemcell_formats": []interface{}{"vsphere-ova", "vsphere-ovf"},
+			"api_version":      float64(cpi.ApiVersion),
+		}))
+		Expect(res.Error).Should(BeNil())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(res.Log).ShouldNot(BeEmpty())
+	})
+
+	It("returns the stemcell formats from config", func() {
+		ctx.Config.StemcellFormats = []string{"photon-ova"}
+		actions := map[string]cpi.ActionFn{
+			"info": Info,
+		}
+		res, err := GetResponse(dispatch(ctx, actions, "info", []interface{}{}))
+
+		result, ok := res.Result.(map[string]interface{})
+		Expect(ok).Should(BeTrue())
+		Expect(result["stemcell_formats"]).Should(Equal([]interface{}{"photon-ova"}))
+		Expect(res.Error).Should(BeNil())
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
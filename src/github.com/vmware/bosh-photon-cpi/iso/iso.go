@@ -0,0 +1,424 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+// Package iso builds small ISO 9660 images in memory. Images carry a Joliet
+// directory tree next to the primary one, so file names keep their case and
+// characters when the image is mounted.
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// The first 16 sectors are the system area, volume descriptors follow
+const firstDescriptorSector = 16
+
+type Image struct {
+	volumeID string
+	root     *entry
+}
+
+type entry struct {
+	name     string
+	data     []byte
+	dir      bool
+	parent   *entry
+	children []*entry
+	extent   uint32
+}
+
+// Position of a directory in one of the directory trees
+type dirLayout struct {
+	number uint16
+	extent uint32
+	size   uint32
+}
+
+// One of the two directory trees, which differ only in the identifiers they use
+type tree struct {
+	ident   func(e *entry) []byte
+	dirs    []*entry
+	layout  map[*entry]*dirLayout
+	pathLen uint32
+	lTable  uint32
+	mTable  uint32
+}
+
+func New(volumeID string) *Image {
+	root := &entry{dir: true}
+	root.parent = root
+	return &Image{volumeID: volumeID, root: root}
+}
+
+// Adds a file at the given slash separated path, creating parent directories as needed
+func (img *Image) AddFile(path string, data []byte) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	dir := img.root
+	for i, name := range parts {
+		if name == "" || name == "." || name == ".." {
+			return fmt.Errorf("Invalid path '%s'", path)
+		}
+		child := dir.child(name)
+		last := i == len(parts)-1
+		if child == nil {
+			child = &entry{name: name, dir: !last, parent: dir}
+			dir.children = append(dir.children, child)
+		} else if last || !child.dir {
+			return fmt.Errorf("Path '%s' conflicts with an existing entry", path)
+		}
+		if last {
+			child.data = data
+		}
+		dir = child
+	}
+	return nil
+}
+
+// Lays out the image and returns a reader over it
+func (img *Image) NewReader() *bytes.Reader {
+	return bytes.NewReader(img.Bytes())
+}
+
+// Lays out the image and returns its contents
+func (img *Image) Bytes() []byte {
+	now := time.Now().UTC()
+	trees := []*tree{
+		img.newTree(primaryIdent),
+		img.newTree(jolietIdent),
+	}
+
+	// Primary, supplementary and terminating volume descriptors come first
+	sector := uint32(firstDescriptorSector + 3)
+	for _, t := range trees {
+		tableSectors := sectors(t.pathLen)
+		t.lTable = sector
+		t.mTable = sector + tableSectors
+		sector += 2 * tableSectors
+	}
+	for _, t := range trees {
+		for _, dir := range t.dirs {
+			t.layout[dir].extent = sector
+			sector += sectors(t.layout[dir].size)
+		}
+	}
+	for _, file := range img.files() {
+		file.extent = sector
+		sector += sectors(uint32(len(file.data)))
+	}
+
+	out := make([]byte, sector*sectorSize)
+	descriptors := out[firstDescriptorSector*sectorSize:]
+	copy(descriptors, img.volumeDescriptor(1, trees[0], sector, now))
+	copy(descriptors[sectorSize:], img.volumeDescriptor(2, trees[1], sector, now))
+	copy(descriptors[2*sectorSize:], []byte{255, 'C', 'D', '0', '0', '1', 1})
+
+	for _, t := range trees {
+		copy(out[t.lTable*sectorSize:], t.pathTable(binary.LittleEndian))
+		copy(out[t.mTable*sectorSize:], t.pathTable(binary.BigEndian))
+		for _, dir := range t.dirs {
+			copy(out[t.layout[dir].extent*sectorSize:], t.dirContents(dir, now))
+		}
+	}
+	for _, file := range img.files() {
+		copy(out[file.extent*sectorSize:], file.data)
+	}
+	return out
+}
+
+func (e *entry) child(name string) *entry {
+	for _, c := range e.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns all files in a stable order
+func (img *Image) files() (res []*entry) {
+	var walk func(e *entry)
+	walk = func(e *entry) {
+		for _, c := range sortedChildren(e, jolietIdent) {
+			if c.dir {
+				walk(c)
+			} else {
+				res = append(res, c)
+			}
+		}
+	}
+	walk(img.root)
+	return
+}
+
+func (img *Image) newTree(ident func(e *entry) []byte) *tree {
+	t := &tree{ident: ident, layout: map[*entry]*dirLayout{}}
+	// Directories are numbered breadth first for the path table
+	queue := []*entry{img.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		t.dirs = append(t.dirs, dir)
+		t.layout[dir] = &dirLayout{number: uint16(len(t.dirs))}
+		for _, c := range sortedChildren(dir, ident) {
+			if c.dir {
+				queue = append(queue, c)
+			}
+		}
+	}
+	// Record lengths don't depend on extents, so sizes can be worked out up front
+	for _, dir := range t.dirs {
+		t.layout[dir].size = uint32(len(t.dirContents(dir, time.Time{})))
+		t.pathLen += uint32(len(pathRecord(t.dirIdent(dir), 0, 0, binary.LittleEndian)))
+	}
+	return t
+}
+
+func (t *tree) dirIdent(dir *entry) []byte {
+	if dir.parent == dir {
+		return []byte{0}
+	}
+	return t.ident(dir)
+}
+
+func (t *tree) pathTable(order binary.ByteOrder) []byte {
+	buf := &bytes.Buffer{}
+	for _, dir := range t.dirs {
+		l := t.layout[dir]
+		buf.Write(pathRecord(t.dirIdent(dir), l.extent, t.layout[dir.parent].number, order))
+	}
+	return buf.Bytes()
+}
+
+// Directory records may not cross sector boundaries, so they are padded to the next sector
+func (t *tree) dirContents(dir *entry, now time.Time) []byte {
+	self := t.layout[dir]
+	parent := t.layout[dir.parent]
+	records := [][]byte{
+		dirRecord([]byte{0}, self.extent, self.size, true, now),
+		dirRecord([]byte{1}, parent.extent, parent.size, true, now),
+	}
+	for _, c := range sortedChildren(dir, t.ident) {
+		if c.dir {
+			l := t.layout[c]
+			records = append(records, dirRecord(t.ident(c), l.extent, l.size, true, now))
+		} else {
+			records = append(records, dirRecord(t.ident(c), c.extent, uint32(len(c.data)), false, now))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, r := range records {
+		if left := sectorSize - buf.Len()%sectorSize; len(r) > left {
+			buf.Write(make([]byte, left))
+		}
+		buf.Write(r)
+	}
+	if rem := buf.Len() % sectorSize; rem != 0 {
+		buf.Write(make([]byte, sectorSize-rem))
+	}
+	return buf.Bytes()
+}
+
+func (img *Image) volumeDescriptor(kind byte, t *tree, totalSectors uint32, now time.Time) []byte {
+	joliet := kind == 2
+	text := func(s string, size int) []byte {
+		if joliet {
+			return ucs2(s, size)
+		}
+		return padded([]byte(s), size, ' ')
+	}
+
+	d := make([]byte, sectorSize)
+	d[0] = kind
+	copy(d[1:], "CD001")
+	d[6] = 1
+	copy(d[8:40], text("", 32))
+	copy(d[40:72], text(img.volumeID, 32))
+	putBoth32(d[80:], totalSectors)
+	if joliet {
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], t.pathLen)
+	binary.LittleEndian.PutUint32(d[140:], t.lTable)
+	binary.BigEndian.PutUint32(d[148:], t.mTable)
+	root := t.layout[img.root]
+	copy(d[156:190], dirRecord([]byte{0}, root.extent, root.size, true, now))
+	copy(d[190:318], text("", 128))
+	copy(d[318:446], text("", 128))
+	copy(d[446:574], text("", 128))
+	copy(d[574:702], text("", 128))
+	copy(d[702:739], text("", 37))
+	copy(d[739:776], text("", 37))
+	copy(d[776:813], text("", 37))
+	copy(d[813:830], decDateTime(now))
+	copy(d[830:847], decDateTime(now))
+	copy(d[847:864], decDateTime(time.Time{}))
+	copy(d[864:881], decDateTime(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+func dirRecord(ident []byte, extent uint32, size uint32, dir bool, now time.Time) []byte {
+	length := 33 + len(ident)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBoth32(r[2:], extent)
+	putBoth32(r[10:], size)
+	if !now.IsZero() {
+		r[18] = byte(now.Year() - 1900)
+		r[19] = byte(now.Month())
+		r[20] = byte(now.Day())
+		r[21] = byte(now.Hour())
+		r[22] = byte(now.Minute())
+		r[23] = byte(now.Second())
+	}
+	if dir {
+		r[25] = 2
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(ident))
+	copy(r[33:], ident)
+	return r
+}
+
+func pathRecord(ident []byte, extent uint32, parent uint16, order binary.ByteOrder) []byte {
+	length := 8 + len(ident)
+	if length%2 == 1 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(len(ident))
+	order.PutUint32(r[2:], extent)
+	order.PutUint16(r[6:], parent)
+	copy(r[8:], ident)
+	return r
+}
+
+// Identifiers in the primary tree are limited to upper case letters, digits
+// and underscores. Files get a version suffix.
+func primaryIdent(e *entry) []byte {
+	name, ext := e.name, ""
+	if !e.dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			name, ext = name[:i], name[i+1:]
+		}
+	}
+	name, ext = dChars(name), dChars(ext)
+	if e.dir {
+		return []byte(truncate(name, 31))
+	}
+	if len(name)+len(ext) > 28 {
+		ext = truncate(ext, 3)
+		name = truncate(name, 28-len(ext))
+	}
+	return []byte(name + "." + ext + ";1")
+}
+
+func jolietIdent(e *entry) []byte {
+	name := e.name
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return ucs2(name, 2*len(utf16.Encode([]rune(name))))
+}
+
+func dChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, s)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Encodes s as big endian UCS-2, padded with spaces
+func ucs2(s string, size int) []byte {
+	b := make([]byte, size)
+	units := utf16.Encode([]rune(s))
+	for i := 0; i+1 < size; i += 2 {
+		u := uint16(' ')
+		if i/2 < len(units) {
+			u = units[i/2]
+		}
+		binary.BigEndian.PutUint16(b[i:], u)
+	}
+	return b
+}
+
+func padded(s []byte, size int, pad byte) []byte {
+	b := bytes.Repeat([]byte{pad}, size)
+	copy(b, s)
+	return b
+}
+
+func decDateTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	s := fmt.Sprintf("%04d%02d%02d%02d%02d%02d00",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	return append([]byte(s), 0)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func sectors(size uint32) uint32 {
+	return (size + sectorSize - 1) / sectorSize
+}
+
+type entriesByIdent struct {
+	entries []*entry
+	ident   func(e *entry) []byte
+}
+
+func (s entriesByIdent) Len() int      { return len(s.entries) }
+func (s entriesByIdent) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s entriesByIdent) Less(i, j int) bool {
+	return bytes.Compare(s.ident(s.entries[i]), s.ident(s.entries[j])) < 0
+}
+
+func sortedChildren(e *entry, ident func(e *entry) []byte) []*entry {
+	res := make([]*entry, len(e.children))
+	copy(res, e.children)
+	sort.Sort(entriesByIdent{res, ident})
+	return res
+}
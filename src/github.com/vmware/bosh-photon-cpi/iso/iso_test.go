@@ -0,0 +1,311 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package iso
+
+import (
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestISO(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ISO Suite")
+}
+
+// What the tests read back from a volume descriptor
+type testVolume struct {
+	joliet   bool
+	volumeID string
+	root     testRecord
+	pathLen  uint32
+	lTable   uint32
+	mTable   uint32
+}
+
+type testRecord struct {
+	name   string
+	extent uint32
+	size   uint32
+	dir    bool
+}
+
+type testPathRecord struct {
+	name   string
+	extent uint32
+	parent uint16
+}
+
+func readVolume(data []byte, sector int) testVolume {
+	d := data[sector*sectorSize : (sector+1)*sectorSize]
+	Expect(string(d[1:6])).To(Equal("CD001"))
+	v := testVolume{
+		joliet:  d[0] == 2,
+		pathLen: binary.LittleEndian.Uint32(d[132:]),
+		lTable:  binary.LittleEndian.Uint32(d[140:]),
+		mTable:  binary.BigEndian.Uint32(d[148:]),
+	}
+	Expect(binary.BigEndian.Uint32(d[136:])).To(Equal(v.pathLen))
+	v.volumeID = strings.TrimRight(v.decode(d[40:72]), " ")
+	v.root = v.readRecord(d[156:190])
+	return v
+}
+
+func (v testVolume) decode(b []byte) string {
+	if !v.joliet {
+		return string(b)
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func (v testVolume) readRecord(r []byte) testRecord {
+	// Both byte orders have to agree
+	Expect(binary.BigEndian.Uint32(r[6:])).To(Equal(binary.LittleEndian.Uint32(r[2:])))
+	Expect(binary.BigEndian.Uint32(r[14:])).To(Equal(binary.LittleEndian.Uint32(r[10:])))
+	ident := r[33 : 33+int(r[32])]
+	name := v.decode(ident)
+	if len(ident) == 1 && ident[0] <= 1 {
+		name = string(ident)
+	}
+	return testRecord{
+		name:   name,
+		extent: binary.LittleEndian.Uint32(r[2:]),
+		size:   binary.LittleEndian.Uint32(r[10:]),
+		dir:    r[25]&2 != 0,
+	}
+}
+
+// Returns the entries of a directory, without the self and parent records
+func (v testVolume) readDir(data []byte, dir testRecord) (res []testRecord) {
+	contents := data[dir.extent*sectorSize : dir.extent*sectorSize+dir.size]
+	for i := 0; i < len(contents); {
+		length := int(contents[i])
+		if length == 0 {
+			// Records don't cross sectors, the rest of this one is padding
+			i = (i/sectorSize + 1) * sectorSize
+			continue
+		}
+		rec := v.readRecord(contents[i : i+length])
+		if rec.name != "\x00" && rec.name != "\x01" {
+			res = append(res, rec)
+		}
+		i += length
+	}
+	return
+}
+
+func (v testVolume) lookup(data []byte, path string) (testRecord, bool) {
+	rec := v.root
+	for _, name := range strings.Split(path, "/") {
+		found := false
+		for _, child := range v.readDir(data, rec) {
+			if child.name == name {
+				rec, found = child, true
+				break
+			}
+		}
+		if !found {
+			return testRecord{}, false
+		}
+	}
+	return rec, true
+}
+
+// Returns every directory in the tree, keyed by extent
+func (v testVolume) dirsByExtent(data []byte) map[uint32]testRecord {
+	res := map[uint32]testRecord{}
+	var walk func(dir testRecord)
+	walk = func(dir testRecord) {
+		res[dir.extent] = dir
+		for _, child := range v.readDir(data, dir) {
+			if child.dir {
+				walk(child)
+			}
+		}
+	}
+	walk(v.root)
+	return res
+}
+
+func (v testVolume) readPathTable(data []byte, sector uint32, order binary.ByteOrder) (res []testPathRecord) {
+	table := data[sector*sectorSize : sector*sectorSize+v.pathLen]
+	for i := 0; i < len(table); {
+		identLen := int(table[i])
+		ident := table[i+8 : i+8+identLen]
+		name := v.decode(ident)
+		if identLen == 1 && ident[0] == 0 {
+			name = string(ident)
+		}
+		res = append(res, testPathRecord{
+			name:   name,
+			extent: order.Uint32(table[i+2:]),
+			parent: order.Uint16(table[i+6:]),
+		})
+		i += 8 + identLen + identLen%2
+	}
+	return
+}
+
+func fileContents(data []byte, rec testRecord) []byte {
+	return data[rec.extent*sectorSize : rec.extent*sectorSize+rec.size]
+}
+
+var _ = Describe("Image", func() {
+	var (
+		img *Image
+	)
+
+	BeforeEach(func() {
+		img = New("config-2")
+	})
+
+	It("writes primary and Joliet volume descriptors", func() {
+		Expect(img.AddFile("env", []byte("{}"))).To(Succeed())
+		data := img.Bytes()
+
+		Expect(len(data) % sectorSize).To(Equal(0))
+		primary := readVolume(data, firstDescriptorSector)
+		joliet := readVolume(data, firstDescriptorSector+1)
+		Expect(primary.joliet).To(BeFalse())
+		Expect(primary.volumeID).To(Equal("config-2"))
+		Expect(joliet.joliet).To(BeTrue())
+		Expect(joliet.volumeID).To(Equal("config-2"))
+		Expect(data[(firstDescriptorSector+2)*sectorSize]).To(Equal(byte(255)))
+	})
+
+	It("reads back a file from both directory trees", func() {
+		Expect(img.AddFile("env", []byte("fake-env"))).To(Succeed())
+		data := img.Bytes()
+
+		primary := readVolume(data, firstDescriptorSector)
+		rec, ok := primary.lookup(data, "ENV.;1")
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-env"))
+
+		joliet := readVolume(data, firstDescriptorSector+1)
+		rec, ok = joliet.lookup(data, "env")
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-env"))
+	})
+
+	It("lays out nested directories", func() {
+		Expect(img.AddFile("openstack/latest/user_data", []byte("fake-user-data"))).To(Succeed())
+		Expect(img.AddFile("openstack/latest/meta_data.json", []byte("fake-meta-data"))).To(Succeed())
+		Expect(img.AddFile("openstack/content/0000", []byte("fake-content"))).To(Succeed())
+		data := img.Bytes()
+
+		joliet := readVolume(data, firstDescriptorSector+1)
+		dir, ok := joliet.lookup(data, "openstack/latest")
+		Expect(ok).To(BeTrue())
+		Expect(dir.dir).To(BeTrue())
+		rec, ok := joliet.lookup(data, "openstack/latest/user_data")
+		Expect(ok).To(BeTrue())
+		Expect(rec.dir).To(BeFalse())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-user-data"))
+		rec, ok = joliet.lookup(data, "openstack/content/0000")
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-content"))
+
+		primary := readVolume(data, firstDescriptorSector)
+		rec, ok = primary.lookup(data, "OPENSTACK/LATEST/META_DATA.JSON;1")
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-meta-data"))
+	})
+
+	It("keeps long and lower case names in the Joliet tree only", func() {
+		long := "a-rather-long-lower-case-file-name-for-the-agent.json"
+		Expect(img.AddFile(long, []byte("fake-data"))).To(Succeed())
+		data := img.Bytes()
+
+		joliet := readVolume(data, firstDescriptorSector+1)
+		rec, ok := joliet.lookup(data, long)
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-data"))
+
+		primary := readVolume(data, firstDescriptorSector)
+		entries := primary.readDir(data, primary.root)
+		Expect(entries).To(HaveLen(1))
+		name := entries[0].name
+		Expect(name).To(HaveSuffix(";1"))
+		Expect(len(name)).To(BeNumerically("<=", 32))
+		Expect(name).To(MatchRegexp(`^[A-Z0-9_]+\.[A-Z0-9_]*;1$`))
+		Expect(entries[0].extent).To(Equal(rec.extent))
+	})
+
+	It("truncates Joliet names to 64 characters", func() {
+		Expect(img.AddFile(strings.Repeat("x", 70), []byte("fake-data"))).To(Succeed())
+		data := img.Bytes()
+
+		joliet := readVolume(data, firstDescriptorSector+1)
+		_, ok := joliet.lookup(data, strings.Repeat("x", 64))
+		Expect(ok).To(BeTrue())
+	})
+
+	It("writes path tables that match the directory records", func() {
+		Expect(img.AddFile("openstack/latest/user_data", []byte("fake-user-data"))).To(Succeed())
+		Expect(img.AddFile("ec2/latest/meta-data.json", []byte("fake-meta-data"))).To(Succeed())
+		data := img.Bytes()
+
+		for _, sector := range []int{firstDescriptorSector, firstDescriptorSector + 1} {
+			v := readVolume(data, sector)
+			lTable := v.readPathTable(data, v.lTable, binary.LittleEndian)
+			mTable := v.readPathTable(data, v.mTable, binary.BigEndian)
+			Expect(mTable).To(Equal(lTable))
+			Expect(lTable).To(HaveLen(5))
+			dirs := v.dirsByExtent(data)
+
+			// Root first, then directories breadth first with parents numbered before children
+			Expect(lTable[0]).To(Equal(testPathRecord{name: "\x00", extent: v.root.extent, parent: 1}))
+			for i, rec := range lTable[1:] {
+				Expect(int(rec.parent)).To(BeNumerically("<=", i+1))
+				parentDir := dirs[lTable[rec.parent-1].extent]
+				found := false
+				for _, child := range v.readDir(data, parentDir) {
+					if child.dir && child.name == rec.name && child.extent == rec.extent {
+						found = true
+					}
+				}
+				Expect(found).To(BeTrue(), "path table entry %q has no matching directory record", rec.name)
+			}
+		}
+	})
+
+	It("writes an empty file", func() {
+		Expect(img.AddFile("empty", []byte{})).To(Succeed())
+		Expect(img.AddFile("env", []byte("fake-env"))).To(Succeed())
+		data := img.Bytes()
+
+		joliet := readVolume(data, firstDescriptorSector+1)
+		rec, ok := joliet.lookup(data, "empty")
+		Expect(ok).To(BeTrue())
+		Expect(rec.size).To(Equal(uint32(0)))
+		rec, ok = joliet.lookup(data, "env")
+		Expect(ok).To(BeTrue())
+		Expect(string(fileContents(data, rec))).To(Equal("fake-env"))
+	})
+
+	It("returns an error for invalid paths", func() {
+		Expect(img.AddFile("", []byte{})).ToNot(Succeed())
+		Expect(img.AddFile("a/../b", []byte{})).ToNot(Succeed())
+	})
+
+	It("returns an error when a path conflicts with an existing entry", func() {
+		Expect(img.AddFile("openstack/latest", []byte{})).To(Succeed())
+		Expect(img.AddFile("openstack/latest", []byte{})).ToNot(Succeed())
+		Expect(img.AddFile("openstack/latest/user_data", []byte{})).ToNot(Succeed())
+	})
+})
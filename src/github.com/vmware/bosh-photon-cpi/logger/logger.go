@@ -17,6 +17,7 @@ import (
 
 const (
 	infoStr = "INFO "
+	warnStr = "WARN "
 	errStr  = "ERROR "
 )
 
@@ -24,6 +25,8 @@ const (
 type Logger interface {
 	Info(v ...interface{})
 	Infof(format string, v ...interface{})
+	Warn(v ...interface{})
+	Warnf(format string, v ...interface{})
 	Error(v ...interface{})
 	Errorf(format string, v ...interface{})
 
@@ -46,6 +49,14 @@ func (l bufferLogger) Infof(format string, v ...interface{}) {
 	l.buffer.WriteString(timestamp() + infoStr + fmt.Sprintf(format, v...) + "\n")
 }
 
+func (l bufferLogger) Warn(v ...interface{}) {
+	l.buffer.WriteString(timestamp() + warnStr + fmt.Sprint(v...) + "\n")
+}
+
+func (l bufferLogger) Warnf(format string, v ...interface{}) {
+	l.buffer.WriteString(timestamp() + warnStr + fmt.Sprintf(format, v...) + "\n")
+}
+
 func (l bufferLogger) Error(v ...interface{}) {
 	l.buffer.WriteString(timestamp() + errStr + fmt.Sprint(v...) + "\n")
 }
@@ -26,18 +26,25 @@ import (
 
 func main() {
 	actions := map[string]cpi.ActionFn{
-		"create_stemcell": CreateStemcell,
-		"delete_stemcell": DeleteStemcell,
-		"create_disk":     CreateDisk,
-		"delete_disk":     DeleteDisk,
-		"has_disk":        HasDisk,
-		"attach_disk":     AttachDisk,
-		"detach_disk":     DetachDisk,
-		"create_vm":       CreateVM,
-		"delete_vm":       DeleteVM,
-		"has_vm":          HasVM,
-		"reboot_vm":       RebootVM,
-		"set_vm_metadata": SetVmMetadata,
+		"create_stemcell":               CreateStemcell,
+		"delete_stemcell":               DeleteStemcell,
+		"create_disk":                   CreateDisk,
+		"delete_disk":                   DeleteDisk,
+		"has_disk":                      HasDisk,
+		"get_disks":                     GetDisks,
+		"resize_disk":                   ResizeDisk,
+		"attach_disk":                   AttachDisk,
+		"detach_disk":                   DetachDisk,
+		"create_vm":                     CreateVM,
+		"delete_vm":                     DeleteVM,
+		"has_vm":                        HasVM,
+		"reboot_vm":                     RebootVM,
+		"calculate_vm_cloud_properties": CalculateVmCloudProperties,
+		"set_vm_metadata":               SetVmMetadata,
+		"set_disk_metadata":             SetDiskMetadata,
+		"snapshot_disk":                 SnapshotDisk,
+		"delete_snapshot":               DeleteSnapshot,
+		"info":                          Info,
 	}
 
 	var res []byte
@@ -59,7 +66,7 @@ func main() {
 	configPath := flag.String("configPath", "", "Path to photon config file")
 	flag.Parse()
 
-	context, err := loadConfig(*configPath)
+	context, err := loadConfig(*configPath, req.Context)
 	if err != nil {
 		res = createErrorResponse(cpi.NewCpiError(err, "Unable to load photon config from path '%s'", *configPath), "")
 		return
@@ -71,10 +78,25 @@ func main() {
 		os.Stderr.WriteString("Unable to create log file for photon CPI")
 	}
 
+	context.ApiVersion = negotiateApiVersion(req.ApiVersion)
+
 	res = dispatch(context, actions, strings.ToLower(req.Method), req.Arguments)
 }
 
-func loadConfig(filePath string) (ctx *cpi.Context, err error) {
+// Directors that predate CPI API v2 don't send a version and are treated as v1.
+// Newer directors may ask for a version beyond what this CPI supports, in which
+// case the highest supported version is used.
+func negotiateApiVersion(requested int) int {
+	if requested < cpi.ApiVersion1 {
+		return cpi.ApiVersion1
+	}
+	if requested > cpi.ApiVersion {
+		return cpi.ApiVersion
+	}
+	return requested
+}
+
+func loadConfig(filePath string, reqContext *cpi.RequestContext) (ctx *cpi.Context, err error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return
@@ -84,27 +106,59 @@ func loadConfig(filePath string) (ctx *cpi.Context, err error) {
 	if err != nil {
 		return
 	}
+	if config.Photon == nil {
+		config.Photon = &cpi.PhotonConfig{}
+	}
+	if reqContext != nil {
+		mergePhotonConfig(config.Photon, reqContext.Photon)
+	}
 
-	token, err := getToken(config.Photon)
+	tokenOptions, err := getTokens(config.Photon)
 	if err != nil {
 		return
 	}
 
-	tokenOptions := &photon.TokenOptions{
-		AccessToken: token}
 	clientConfig := &photon.ClientOptions{
 		IgnoreCertificate: config.Photon.IgnoreCertificate,
 		TokenOptions:      tokenOptions,
 	}
 	ctx = &cpi.Context{
-		Client: photon.NewClient(config.Photon.Target, clientConfig, nil),
-		Config: config,
-		Runner: cmd.NewRunner(),
-		Logger: logger.New(),
+		Client:     photon.NewClient(config.Photon.Target, clientConfig, nil),
+		Config:     config,
+		Runner:     cmd.NewRunner(),
+		Logger:     logger.New(),
+		HTTPClient: newPhotonHTTPClient(config.Photon.IgnoreCertificate),
+		Tokens:     tokenOptions,
+	}
+	if reqContext != nil {
+		ctx.Logger.Infof(
+			"Request context with director_uuid: '%s', request_id: '%s', photon target: '%s', project: '%s'",
+			reqContext.DirectorUUID, reqContext.RequestID, config.Photon.Target, config.Photon.ProjectID)
 	}
 	return
 }
 
+// Overrides any Photon settings that were sent with the request context
+func mergePhotonConfig(config *cpi.PhotonConfig, override *cpi.PhotonConfigOverride) {
+	if override == nil {
+		return
+	}
+	if override.Target != "" {
+		config.Target = override.Target
+	}
+	if override.ProjectID != "" {
+		config.ProjectID = override.ProjectID
+	}
+	if override.IgnoreCertificate != nil {
+		config.IgnoreCertificate = *override.IgnoreCertificate
+	}
+	// Credentials are only meaningful as a pair, so override both or neither
+	if override.Username != "" || override.Password != "" {
+		config.Username = override.Username
+		config.Password = override.Password
+	}
+}
+
 func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method string, args []interface{}) (result []byte) {
 	// Attempt to recover from any panic that may occur during API calls
 	defer func() {
@@ -119,7 +173,7 @@ func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method stri
 		}
 	}()
 	if fn, ok := actions[method]; ok {
-		context.Logger.Infof("Begin action %s", method)
+		context.Logger.Infof("Begin action %s (API version %d)", method, context.ApiVersion)
 		context.Logger.Infof("Raw action arguments: %#v", args)
 
 		res, err := fn(context, args)
@@ -136,7 +190,6 @@ func dispatch(context *cpi.Context, actions map[string]cpi.ActionFn, method stri
 		context.Logger.Error(e)
 		return createErrorResponse(e, context.Logger.LogData())
 	}
-	return
 }
 
 func createResponse(result interface{}, logData string) []byte {
@@ -182,9 +235,11 @@ func createErrorResponse(err error, logData string) []byte {
 	return resBytes
 }
 
-func getToken(photonConfig *cpi.PhotonConfig) (token string, err error) {
+// Returns the access and refresh tokens for the configured user, or no tokens
+// when no credentials are configured
+func getTokens(photonConfig *cpi.PhotonConfig) (tokens *photon.TokenOptions, err error) {
 	if len(photonConfig.Username) == 0 && len(photonConfig.Password) == 0 {
-		return
+		return &photon.TokenOptions{}, nil
 	}
 
 	if len(photonConfig.Username) == 0 || len(photonConfig.Password) == 0 {
@@ -198,11 +253,5 @@ func getToken(photonConfig *cpi.PhotonConfig) (token string, err error) {
 
 	client := photon.NewClient(photonConfig.Target, clientConfig, nil)
 
-	options, err := client.Auth.GetTokensByPassword(photonConfig.Username, photonConfig.Password)
-	if err != nil {
-		return
-	}
-
-	token = options.AccessToken
-	return
+	return client.Auth.GetTokensByPassword(photonConfig.Username, photonConfig.Password)
 }
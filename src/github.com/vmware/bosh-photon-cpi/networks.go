@@ -0,0 +1,390 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	"sort"
+	"time"
+)
+
+// Network types from the director's network spec
+const (
+	manualNetworkType  = "manual"
+	dynamicNetworkType = "dynamic"
+	vipNetworkType     = "vip"
+)
+
+// How long to wait for dynamic networks to get an address once the VM has started
+var (
+	dynamicNetworkTimeout      = 5 * time.Minute
+	dynamicNetworkPollInterval = 5 * time.Second
+)
+
+// Properties a network can provide for the VM through its "default" setting
+var networkDefaults = []string{"dns", "gateway"}
+
+// A network from the director's network spec along with the Photon subnet it is
+// placed on. Subnets given by name are looked up through resolveNetworks. Raw
+// keeps the spec as the director sent it, so settings the CPI doesn't know about,
+// e.g. routes or dns_record_name, still reach the agent.
+type vmNetwork struct {
+	Name       string
+	SubnetID   string
+	SubnetName string
+	RouterName string
+	Spec       cpi.Network
+	Raw        map[string]interface{}
+}
+
+// The network connections of a VM, found in the resource properties of the task
+// returned by VmAPI.GetNetworks
+type vmNetworkConnections struct {
+	NetworkConnections []networkConnection `json:"networkConnections"`
+}
+
+type networkConnection struct {
+	Network     string `json:"network"`
+	MacAddress  string `json:"macAddress"`
+	IpAddress   string `json:"ipAddress"`
+	Netmask     string `json:"netmask"`
+	IsConnected string `json:"isConnected"`
+}
+
+// Parses the director's network spec into networks in the order their NICs are
+// created. The network providing the default gateway comes first so it backs
+// the first NIC, the others follow sorted by name.
+func ParseNetworks(networks map[string]interface{}) (res []vmNetwork, err error) {
+	names := []string{}
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		networkMap, ok := networks[name].(map[string]interface{})
+		if !ok {
+			err = errors.New("error in networks")
+			return
+		}
+
+		spec, specErr := parseNetworkSpec(networkMap)
+		if specErr != nil {
+			err = fmt.Errorf("error in networks:%s: %v", name, specErr)
+			return
+		}
+		switch spec.Type {
+		case "", manualNetworkType, dynamicNetworkType:
+		case vipNetworkType:
+			// A vip network always asks for a specific address, but Photon picks
+			// floating IPs from the router's range and can't be given one
+			err = fmt.Errorf("error in networks:%s: vip networks are not supported, Photon can't assign a specific floating IP", name)
+			return
+		default:
+			err = fmt.Errorf("error in networks:%s: unsupported network type '%s'", name, spec.Type)
+			return
+		}
+
+		cp, ok := networkMap["cloud_properties"].(map[string]interface{})
+		if !ok {
+			err = errors.New("error in networks:cloud_properties")
+			return
+		}
+
+		network_id, hasID := cp["network_id"].(string)
+		network_name, hasName := cp["network_name"].(string)
+		router_name, _ := cp["router_name"].(string)
+		if !hasID && !hasName {
+			err = errors.New("error in networks:cloud_properties:network_id")
+			return
+		}
+		// An ID is unambiguous, so it wins over a name
+		if hasID {
+			network_name, router_name = "", ""
+		}
+
+		res = append(res, vmNetwork{
+			Name:       name,
+			SubnetID:   network_id,
+			SubnetName: network_name,
+			RouterName: router_name,
+			Spec:       spec,
+			Raw:        networkMap,
+		})
+	}
+
+	// A lone network provides everything, whether or not it says so
+	if len(res) == 1 && len(res[0].Spec.Default) == 0 {
+		res[0].Spec.Default = networkDefaults
+	}
+
+	for _, property := range networkDefaults {
+		owners := []string{}
+		for _, network := range res {
+			if network.hasDefault(property) {
+				owners = append(owners, network.Name)
+			}
+		}
+		if len(owners) > 1 {
+			err = fmt.Errorf("error in networks: default %s set on more than one network: %v", property, owners)
+			return
+		}
+	}
+
+	// Move the gateway network to the front, keeping the others in order
+	for i, network := range res {
+		if network.hasDefault("gateway") {
+			copy(res[1:i+1], res[:i])
+			res[0] = network
+			break
+		}
+	}
+	return
+}
+
+func parseNetworkSpec(networkMap map[string]interface{}) (spec cpi.Network, err error) {
+	specJson, err := json.Marshal(networkMap)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(specJson, &spec)
+	return
+}
+
+func (n vmNetwork) hasDefault(property string) bool {
+	for _, d := range n.Spec.Default {
+		if d == property {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the subnet IDs of networks given by name, and optionally router name,
+// in cloud properties. Each name is looked up once per request.
+func resolveNetworks(ctx *cpi.Context, networks []vmNetwork) (err error) {
+	cache := map[string]string{}
+	for i := range networks {
+		if networks[i].SubnetID != "" {
+			continue
+		}
+		key := networks[i].RouterName + "/" + networks[i].SubnetName
+		subnetID, ok := cache[key]
+		if !ok {
+			subnetID, err = findSubnet(ctx, networks[i].SubnetName, networks[i].RouterName)
+			if err != nil {
+				return
+			}
+			cache[key] = subnetID
+		}
+		ctx.Logger.Infof("Resolved network '%s' to subnet %s", networks[i].Name, subnetID)
+		networks[i].SubnetID = subnetID
+	}
+	return
+}
+
+func findSubnet(ctx *cpi.Context, name string, routerName string) (id string, err error) {
+	var subnets *ec.Subnets
+	if routerName == "" {
+		subnets, err = ctx.Client.Subnets.GetAll(&ec.SubnetGetOptions{Name: name})
+	} else {
+		var routerID string
+		routerID, err = findRouter(ctx, routerName)
+		if err != nil {
+			return
+		}
+		subnets, err = ctx.Client.Routers.GetSubnets(routerID, &ec.SubnetGetOptions{Name: name})
+	}
+	if err != nil {
+		return
+	}
+
+	ids := []string{}
+	for _, subnet := range subnets.Items {
+		if subnet.Name == name {
+			ids = append(ids, subnet.ID)
+		}
+	}
+	where := ""
+	if routerName != "" {
+		where = fmt.Sprintf(" on router '%s'", routerName)
+	}
+	switch len(ids) {
+	case 0:
+		err = cpi.NewBoshError(cpi.CloudError, false, "No Photon network named '%s' found%s", name, where)
+	case 1:
+		id = ids[0]
+	default:
+		err = cpi.NewBoshError(cpi.CloudError, false,
+			"Photon network name '%s' is ambiguous, found %d networks%s: %v. Set router_name or network_id instead.",
+			name, len(ids), where, ids)
+	}
+	return
+}
+
+func findRouter(ctx *cpi.Context, name string) (id string, err error) {
+	routers, err := ctx.Client.Projects.GetRouters(ctx.Config.Photon.ProjectID, &ec.RouterGetOptions{Name: name})
+	if err != nil {
+		return
+	}
+	ids := []string{}
+	for _, router := range routers.Items {
+		if router.Name == name {
+			ids = append(ids, router.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		err = cpi.NewBoshError(cpi.CloudError, false, "No Photon router named '%s' found in project", name)
+	case 1:
+		id = ids[0]
+	default:
+		err = cpi.NewBoshError(cpi.CloudError, false,
+			"Photon router name '%s' is ambiguous, found %d routers: %v", name, len(ids), ids)
+	}
+	return
+}
+
+// Returns the IDs of the subnets to connect the VM's NICs to, in NIC order
+func subnetIDs(networks []vmNetwork) (res []string) {
+	for _, network := range networks {
+		res = append(res, network.SubnetID)
+	}
+	return
+}
+
+// Returns the networks keyed by name, as the agent expects them. Each is the
+// director's spec with the settings the CPI worked out laid over it.
+func agentNetworks(networks []vmNetwork) map[string]interface{} {
+	res := map[string]interface{}{}
+	for _, network := range networks {
+		spec := map[string]interface{}{}
+		for key, value := range network.Raw {
+			spec[key] = value
+		}
+		if network.Spec.MAC != "" {
+			spec["mac"] = network.Spec.MAC
+		}
+		if network.Spec.IP != "" {
+			spec["ip"] = network.Spec.IP
+		}
+		if network.Spec.Netmask != "" {
+			spec["netmask"] = network.Spec.Netmask
+		}
+		if _, ok := spec["default"]; !ok && len(network.Spec.Default) > 0 {
+			spec["default"] = network.Spec.Default
+		}
+		res[network.Name] = spec
+	}
+	return res
+}
+
+// Returns the network connections Photon has set up for the VM
+func getVMNetworks(ctx *cpi.Context, vmID string) (res []networkConnection, err error) {
+	task, err := ctx.Client.VMs.GetNetworks(vmID)
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	task, err = ctx.Client.Tasks.Wait(task.ID)
+	if err != nil {
+		return
+	}
+
+	propsJson, err := json.Marshal(task.ResourceProperties)
+	if err != nil {
+		return
+	}
+	vmNetworks := &vmNetworkConnections{}
+	err = json.Unmarshal(propsJson, vmNetworks)
+	if err != nil {
+		return
+	}
+	return vmNetworks.NetworkConnections, nil
+}
+
+// Records the MAC address Photon assigned to each network's NIC, so the agent
+// configures the right interface. Connections are matched by subnet, in order,
+// which also holds up when a VM has several NICs on the same subnet.
+func setNetworkMACs(networks []vmNetwork, connections []networkConnection) {
+	used := make([]bool, len(connections))
+	for i := range networks {
+		for j, conn := range connections {
+			if !used[j] && conn.Network == networks[i].SubnetID {
+				networks[i].Spec.MAC = conn.MacAddress
+				used[j] = true
+				break
+			}
+		}
+	}
+}
+
+// Records the addresses leased to dynamic networks, matching NICs by MAC when
+// known. Returns whether every dynamic network has an address.
+func setDynamicNetworkIPs(networks []vmNetwork, connections []networkConnection) bool {
+	complete := true
+	used := make([]bool, len(connections))
+	for i := range networks {
+		if networks[i].Spec.Type != dynamicNetworkType {
+			continue
+		}
+		for j, conn := range connections {
+			if used[j] || conn.Network != networks[i].SubnetID {
+				continue
+			}
+			if networks[i].Spec.MAC != "" && conn.MacAddress != networks[i].Spec.MAC {
+				continue
+			}
+			used[j] = true
+			networks[i].Spec.IP = conn.IpAddress
+			networks[i].Spec.Netmask = conn.Netmask
+			break
+		}
+		if networks[i].Spec.IP == "" {
+			complete = false
+		}
+	}
+	return complete
+}
+
+// Polls the VM's network connections until every dynamic network has been
+// leased an address or dynamicNetworkTimeout runs out
+func waitForDynamicNetworkIPs(ctx *cpi.Context, vmID string, networks []vmNetwork) error {
+	hasDynamic := false
+	for _, network := range networks {
+		if network.Spec.Type == dynamicNetworkType {
+			hasDynamic = true
+		}
+	}
+	if !hasDynamic {
+		return nil
+	}
+
+	ctx.Logger.Infof("Waiting for dynamic networks of VM %s to get an address", vmID)
+	deadline := time.Now().Add(dynamicNetworkTimeout)
+	for {
+		connections, err := getVMNetworks(ctx, vmID)
+		if err != nil {
+			return err
+		}
+		if setDynamicNetworkIPs(networks, connections) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out after %v waiting for dynamic networks of VM %s to get an address",
+				dynamicNetworkTimeout, vmID)
+		}
+		time.Sleep(dynamicNetworkPollInterval)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Networks", func() {
+	network := func(networkID string, defaults ...interface{}) map[string]interface{} {
+		res := map[string]interface{}{
+			"type":             "manual",
+			"ip":               "10.0.0.5",
+			"cloud_properties": map[string]interface{}{"network_id": networkID},
+		}
+		if len(defaults) > 0 {
+			res["default"] = defaults
+		}
+		return res
+	}
+	agentNetwork := func(networks []vmNetwork, name string) map[string]interface{} {
+		return agentNetworks(networks)[name].(map[string]interface{})
+	}
+
+	Describe("ParseNetworks", func() {
+		It("orders networks by name with the gateway network first", func() {
+			networks := map[string]interface{}{
+				"c-net": network("subnet-c"),
+				"a-net": network("subnet-a", "dns"),
+				"b-net": network("subnet-b", "gateway"),
+				"d-net": network("subnet-d"),
+			}
+			for i := 0; i < 10; i++ {
+				res, err := ParseNetworks(networks)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(subnetIDs(res)).To(Equal([]string{"subnet-b", "subnet-a", "subnet-c", "subnet-d"}))
+			}
+		})
+
+		It("keeps the network spec for the agent", func() {
+			res, err := ParseNetworks(map[string]interface{}{"default": network("subnet-a", "dns", "gateway")})
+			Expect(err).ToNot(HaveOccurred())
+
+			spec := agentNetwork(res, "default")
+			Expect(spec["type"]).To(Equal("manual"))
+			Expect(spec["ip"]).To(Equal("10.0.0.5"))
+			Expect(spec["default"]).To(ConsistOf("dns", "gateway"))
+			Expect(spec["cloud_properties"]).To(HaveKeyWithValue("network_id", "subnet-a"))
+		})
+
+		It("passes on settings the CPI does not know about", func() {
+			net := network("subnet-a", "dns", "gateway")
+			net["netmask"] = "255.255.255.0"
+			net["prefix"] = "24"
+			net["dns_record_name"] = "0.web.default.fake-deployment.bosh"
+			net["routes"] = []interface{}{
+				map[string]interface{}{"destination": "10.1.0.0", "netmask": "255.255.0.0", "gateway": "10.0.0.1"},
+			}
+			res, err := ParseNetworks(map[string]interface{}{"default": net})
+			Expect(err).ToNot(HaveOccurred())
+			setNetworkMACs(res, []networkConnection{networkConnection{Network: "subnet-a", MacAddress: "mac-a"}})
+
+			spec := agentNetwork(res, "default")
+			Expect(spec["prefix"]).To(Equal("24"))
+			Expect(spec["dns_record_name"]).To(Equal("0.web.default.fake-deployment.bosh"))
+			Expect(spec["routes"]).To(Equal(net["routes"]))
+			Expect(spec["netmask"]).To(Equal("255.255.255.0"))
+			Expect(spec["mac"]).To(Equal("mac-a"))
+			Expect(net).ToNot(HaveKey("mac"))
+		})
+
+		It("makes a lone network the default", func() {
+			res, err := ParseNetworks(map[string]interface{}{"default": network("subnet-a")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res[0].Spec.Default).To(Equal([]string{"dns", "gateway"}))
+			Expect(agentNetwork(res, "default")["default"]).To(Equal([]string{"dns", "gateway"}))
+		})
+
+		It("returns an error when more than one network provides the gateway", func() {
+			_, err := ParseNetworks(map[string]interface{}{
+				"a-net": network("subnet-a", "gateway"),
+				"b-net": network("subnet-b", "dns", "gateway"),
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error for unsupported network types", func() {
+			net := network("subnet-a")
+			net["type"] = "fake-type"
+			_, err := ParseNetworks(map[string]interface{}{"default": net})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns an error for vip networks", func() {
+			_, err := ParseNetworks(map[string]interface{}{
+				"default": network("subnet-a"),
+				"public":  map[string]interface{}{"type": "vip", "ip": "10.0.0.1"},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("vip networks are not supported"))
+		})
+
+		It("returns an error when network_id is missing", func() {
+			_, err := ParseNetworks(map[string]interface{}{
+				"default": map[string]interface{}{"cloud_properties": map[string]interface{}{}},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("setNetworkMACs", func() {
+		It("matches NICs to networks by subnet in order", func() {
+			networks, err := ParseNetworks(map[string]interface{}{
+				"a-net": network("subnet-a", "dns", "gateway"),
+				"b-net": network("subnet-b"),
+				"c-net": network("subnet-a"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			setNetworkMACs(networks, []networkConnection{
+				networkConnection{Network: "subnet-b", MacAddress: "mac-b"},
+				networkConnection{Network: "subnet-a", MacAddress: "mac-a1"},
+				networkConnection{Network: "subnet-a", MacAddress: "mac-a2"},
+			})
+
+			Expect(agentNetwork(networks, "a-net")["mac"]).To(Equal("mac-a1"))
+			Expect(agentNetwork(networks, "b-net")["mac"]).To(Equal("mac-b"))
+			Expect(agentNetwork(networks, "c-net")["mac"]).To(Equal("mac-a2"))
+		})
+	})
+
+	Describe("dynamic networks", func() {
+		var (
+			server   *httptest.Server
+			ctx      *cpi.Context
+			networks []vmNetwork
+			leases   int
+		)
+
+		BeforeEach(func() {
+			server = NewMockServer()
+			Activate(true)
+			httpClient := &http.Client{Transport: DefaultMockTransport}
+			ctx = &cpi.Context{
+				Client: ec.NewTestClient(server.URL, nil, httpClient),
+				Config: &cpi.Config{},
+				Logger: logger.New(),
+			}
+
+			dhcp := network("subnet-a", "dns", "gateway")
+			dhcp["type"] = "dynamic"
+			delete(dhcp, "ip")
+			var err error
+			networks, err = ParseNetworks(map[string]interface{}{
+				"dhcp":   dhcp,
+				"manual": network("subnet-b"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			networks[0].Spec.MAC = "mac-a"
+
+			// Only hand out an address on the second query
+			leases = 0
+			networksTask := &ec.Task{Operation: "GET_NETWORKS", State: "QUEUED", ID: "fake-networks-task-id"}
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/fake-vm-id/subnets",
+				CreateResponder(200, ToJson(networksTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+networksTask.ID,
+				func(req *http.Request) (*http.Response, error) {
+					conn := networkConnection{Network: "subnet-a", MacAddress: "mac-a"}
+					if leases > 0 {
+						conn.IpAddress = "10.0.0.20"
+						conn.Netmask = "255.255.255.0"
+					}
+					leases++
+					task := &ec.Task{
+						Operation:          "GET_NETWORKS",
+						State:              "COMPLETED",
+						ID:                 networksTask.ID,
+						ResourceProperties: &vmNetworkConnections{NetworkConnections: []networkConnection{conn}},
+					}
+					return CreateResponder(200, ToJson(task))(req)
+				})
+
+			dynamicNetworkPollInterval = time.Millisecond
+		})
+
+		AfterEach(func() {
+			server.Close()
+			dynamicNetworkTimeout = 5 * time.Minute
+			dynamicNetworkPollInterval = 5 * time.Second
+		})
+
+		It("waits for dynamic networks to get an address", func() {
+			err := waitForDynamicNetworkIPs(ctx, "fake-vm-id", networks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(leases).To(Equal(2))
+
+			Expect(agentNetwork(networks, "dhcp")["ip"]).To(Equal("10.0.0.20"))
+			Expect(agentNetwork(networks, "dhcp")["netmask"]).To(Equal("255.255.255.0"))
+			Expect(agentNetwork(networks, "manual")["ip"]).To(Equal("10.0.0.5"))
+		})
+
+		It("returns an error when no address is leased in time", func() {
+			dynamicNetworkTimeout = 0
+			err := waitForDynamicNetworkIPs(ctx, "fake-vm-id", networks)
+			Expect(err).To(HaveOccurred())
+			Expect(agentNetwork(networks, "dhcp")).ToNot(HaveKey("ip"))
+		})
+	})
+
+	Describe("resolveNetworks", func() {
+		var (
+			server  *httptest.Server
+			ctx     *cpi.Context
+			lookups int
+		)
+
+		named := func(networkName string, routerName string, defaults ...interface{}) map[string]interface{} {
+			res := network("", defaults...)
+			cp := map[string]interface{}{"network_name": networkName}
+			if routerName != "" {
+				cp["router_name"] = routerName
+			}
+			res["cloud_properties"] = cp
+			return res
+		}
+
+		BeforeEach(func() {
+			server = NewMockServer()
+			Activate(true)
+			httpClient := &http.Client{Transport: DefaultMockTransport}
+			ctx = &cpi.Context{
+				Client: ec.NewTestClient(server.URL, nil, httpClient),
+				Config: &cpi.Config{Photon: &cpi.PhotonConfig{ProjectID: "fake-project-id"}},
+				Logger: logger.New(),
+			}
+
+			lookups = 0
+			subnets := map[string]*ec.Subnets{
+				"net-a": &ec.Subnets{Items: []ec.Subnet{
+					ec.Subnet{ID: "subnet-a", Name: "net-a"},
+					ec.Subnet{ID: "subnet-a-2", Name: "net-a-2"},
+				}},
+				"net-b": &ec.Subnets{Items: []ec.Subnet{
+					ec.Subnet{ID: "subnet-b-1", Name: "net-b"},
+					ec.Subnet{ID: "subnet-b-2", Name: "net-b"},
+				}},
+				"net-c": &ec.Subnets{Items: []ec.Subnet{}},
+			}
+			for name, list := range subnets {
+				RegisterResponder(
+					"GET",
+					server.URL+rootUrl+"/subnets?name="+name,
+					func(list *ec.Subnets) Responder {
+						return func(req *http.Request) (*http.Response, error) {
+							lookups++
+							return CreateResponder(200, ToJson(list))(req)
+						}
+					}(list))
+			}
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/projects/fake-project-id/routers?name=router-1",
+				CreateResponder(200, ToJson(&ec.Routers{Items: []ec.Router{ec.Router{ID: "router-1-id", Name: "router-1"}}})))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/projects/fake-project-id/routers?name=router-2",
+				CreateResponder(200, ToJson(&ec.Routers{Items: []ec.Router{}})))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/routers/router-1-id/subnets?name=net-b",
+				CreateResponder(200, ToJson(&ec.Subnets{Items: []ec.Subnet{ec.Subnet{ID: "subnet-b-1", Name: "net-b"}}})))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("resolves network names once per request", func() {
+			networks, err := ParseNetworks(map[string]interface{}{
+				"a-net": named("net-a", "", "dns", "gateway"),
+				"b-net": named("net-a", ""),
+				"c-net": network("subnet-c"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(subnetIDs(networks)).To(Equal([]string{"subnet-a", "subnet-a", "subnet-c"}))
+			Expect(lookups).To(Equal(1))
+		})
+
+		It("resolves network names on a router", func() {
+			networks, err := ParseNetworks(map[string]interface{}{"default": named("net-b", "router-1")})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(subnetIDs(networks)).To(Equal([]string{"subnet-b-1"}))
+		})
+
+		It("prefers network_id over network_name", func() {
+			net := network("subnet-x")
+			net["cloud_properties"].(map[string]interface{})["network_name"] = "net-b"
+			networks, err := ParseNetworks(map[string]interface{}{"default": net})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(subnetIDs(networks)).To(Equal([]string{"subnet-x"}))
+			Expect(lookups).To(Equal(0))
+		})
+
+		It("returns an error for an ambiguous network name", func() {
+			networks, err := ParseNetworks(map[string]interface{}{"default": named("net-b", "")})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("ambiguous"))
+			Expect(err.Error()).To(ContainSubstring("subnet-b-2"))
+		})
+
+		It("returns an error for a missing network name", func() {
+			networks, err := ParseNetworks(map[string]interface{}{"default": named("net-c", "")})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("net-c"))
+		})
+
+		It("returns an error for a missing router name", func() {
+			networks, err := ParseNetworks(map[string]interface{}{"default": named("net-b", "router-2")})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = resolveNetworks(ctx, networks)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("router-2"))
+		})
+	})
+})
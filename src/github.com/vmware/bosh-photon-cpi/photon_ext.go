@@ -0,0 +1,162 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+// Calls to Photon endpoints that the pinned SDK doesn't wrap. They are kept in
+// the CPI rather than added to the vendored SDK, which update-deps replaces.
+// Neither the pinned SDK nor its API types describe these endpoints, so no
+// Photon Controller release is known to provide them. A 404 or 405 response is
+// reported as errPhotonEndpointUnsupported for callers to fall back on.
+
+const photonAPIRoot = "/v1"
+
+// How long a single call to Photon may take. The calls only start tasks, which
+// are then waited on through the SDK.
+const photonRequestTimeout = 2 * time.Minute
+
+var errPhotonEndpointUnsupported = errors.New("Endpoint not supported by this Photon Controller")
+
+// Builds the client used for Photon endpoints the SDK doesn't wrap, with the
+// proxy and timeout settings of http.DefaultTransport
+func newPhotonHTTPClient(ignoreCert bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: ignoreCert},
+		},
+		Timeout: photonRequestTimeout,
+	}
+}
+
+// Posts body as JSON to the API path and returns the task Photon starts for it
+func postPhotonTask(ctx *cpi.Context, path string, body interface{}) (task *ec.Task, err error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	res, resBody, err := postPhoton(ctx, path, reqBody)
+	if err != nil {
+		return
+	}
+
+	// Like the SDK, renew an expired access token once and try again
+	if res.StatusCode == http.StatusUnauthorized && ctx.Tokens != nil && ctx.Tokens.RefreshToken != "" {
+		apiErr := ec.ApiError{}
+		if json.Unmarshal(resBody, &apiErr) == nil && apiErr.Code == "ExpiredAuthToken" {
+			tokens, err := ctx.Client.Auth.GetTokensByRefreshToken(ctx.Tokens.RefreshToken)
+			if err != nil {
+				return nil, err
+			}
+			ctx.Tokens.AccessToken = tokens.AccessToken
+			res, resBody, err = postPhoton(ctx, path, reqBody)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound, res.StatusCode == http.StatusMethodNotAllowed:
+		ctx.Logger.Infof("Photon answered POST %s with %d", path, res.StatusCode)
+		return nil, errPhotonEndpointUnsupported
+	case res.StatusCode/100 != 2:
+		apiErr := ec.ApiError{}
+		if json.Unmarshal(resBody, &apiErr) != nil {
+			return nil, ec.HttpError{StatusCode: res.StatusCode, Message: string(resBody)}
+		}
+		apiErr.HttpStatusCode = res.StatusCode
+		return nil, apiErr
+	}
+
+	task = &ec.Task{}
+	err = json.Unmarshal(resBody, task)
+	if err != nil {
+		return nil, err
+	}
+	if task.State == "ERROR" {
+		return task, ec.TaskError{ID: task.ID}
+	}
+	return
+}
+
+func postPhoton(ctx *cpi.Context, path string, reqBody []byte) (res *http.Response, resBody []byte, err error) {
+	req, err := http.NewRequest("POST", ctx.Client.Endpoint+photonAPIRoot+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ctx.Tokens != nil && ctx.Tokens.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ctx.Tokens.AccessToken)
+	}
+
+	client := ctx.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err = client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	resBody, err = ioutil.ReadAll(res.Body)
+	return
+}
+
+// Tag set on a disk, in the same format as ec.VmTag
+type diskTag struct {
+	Tag string `json:"value"`
+}
+
+// Sets a tag on a persistent disk
+func setDiskTag(ctx *cpi.Context, diskID string, tag string) (*ec.Task, error) {
+	return postPhotonTask(ctx, "/disks/"+diskID+"/tags", &diskTag{Tag: tag})
+}
+
+// Image creation spec for disk images. Like ec.ImageCreateSpec, with tags.
+type diskImageCreateSpec struct {
+	Name            string   `json:"name"`
+	ReplicationType string   `json:"replicationType"`
+	Tags            []string `json:"tags,omitempty"`
+}
+
+// Creates an image from the contents of a persistent disk
+func createDiskImage(ctx *cpi.Context, diskID string, spec *diskImageCreateSpec) (*ec.Task, error) {
+	return postPhotonTask(ctx, "/disks/"+diskID+"/create_image", spec)
+}
+
+// Resize spec for persistent disks
+type diskResizeSpec struct {
+	CapacityGB int `json:"capacityGb"`
+}
+
+// Grows a persistent disk to the given size
+func resizeDisk(ctx *cpi.Context, diskID string, sizeGB int) (*ec.Task, error) {
+	return postPhotonTask(ctx, "/disks/"+diskID+"/resize", &diskResizeSpec{CapacityGB: sizeGB})
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+var _ = Describe("Photon extensions", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
+			Logger: logger.New(),
+			Tokens: &ec.TokenOptions{AccessToken: "fake-token"},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("postPhotonTask", func() {
+		It("returns the task and sends the access token", func() {
+			task := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-task-id"}
+			auth := ""
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				func(req *http.Request) (*http.Response, error) {
+					auth = req.Header.Get("Authorization")
+					return CreateResponder(200, ToJson(task))(req)
+				})
+
+			res, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res).Should(Equal(task))
+			Expect(auth).Should(Equal("Bearer fake-token"))
+		})
+		It("sends a token the SDK has refreshed", func() {
+			task := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-task-id"}
+			auth := ""
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				func(req *http.Request) (*http.Response, error) {
+					auth = req.Header.Get("Authorization")
+					return CreateResponder(200, ToJson(task))(req)
+				})
+
+			ctx.Tokens.AccessToken = "fake-refreshed-token"
+			_, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(auth).Should(Equal("Bearer fake-refreshed-token"))
+		})
+		It("returns an expired token error when there is no refresh token", func() {
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				CreateResponder(401, ToJson(ec.ApiError{Code: "ExpiredAuthToken"})))
+
+			_, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(ec.ApiError).Code).Should(Equal("ExpiredAuthToken"))
+		})
+		It("reports endpoints Photon doesn't have as unsupported", func() {
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				CreateResponder(405, ""))
+
+			_, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).Should(Equal(errPhotonEndpointUnsupported))
+		})
+		It("returns API errors", func() {
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				CreateResponder(500, ToJson(ec.ApiError{Code: "InternalError"})))
+
+			_, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(ec.ApiError).HttpStatusCode).Should(Equal(500))
+		})
+		It("returns an error for a failed task", func() {
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/fake-disk-id/tags",
+				CreateResponder(200, ToJson(&ec.Task{State: "ERROR", ID: "fake-task-id"})))
+
+			_, err := setDiskTag(ctx, "fake-disk-id", "bosh:job=fake-job")
+			Expect(err).Should(BeAssignableToTypeOf(ec.TaskError{}))
+		})
+	})
+
+	Describe("newPhotonHTTPClient", func() {
+		It("uses the proxy from the environment and has a timeout", func() {
+			client := newPhotonHTTPClient(true)
+			Expect(client.Timeout).Should(Equal(photonRequestTimeout))
+			transport := client.Transport.(*http.Transport)
+			Expect(transport.Proxy).ShouldNot(BeNil())
+			Expect(transport.TLSHandshakeTimeout).ShouldNot(BeZero())
+			Expect(transport.TLSClientConfig.InsecureSkipVerify).Should(BeTrue())
+		})
+	})
+})
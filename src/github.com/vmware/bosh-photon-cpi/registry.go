@@ -0,0 +1,134 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Keeps the agent env in a BOSH registry, so later updates don't have to build
+// and attach a new ISO. An ISO laid out as a config drive is still attached
+// when the VM is created, it tells the agent where the registry is.
+type registryAgentEnvService struct {
+	ctx      *cpi.Context
+	config   *cpi.RegistryConfig
+	endpoint string
+	client   *http.Client
+}
+
+var errRegistryNotFound = errors.New("Agent env not found in registry")
+
+type registrySettingsResponse struct {
+	Settings string `json:"settings"`
+	Status   string `json:"status"`
+}
+
+func newRegistryAgentEnvService(ctx *cpi.Context, config *cpi.RegistryConfig) *registryAgentEnvService {
+	return &registryAgentEnvService{
+		ctx:      ctx,
+		config:   config,
+		endpoint: fmt.Sprintf("http://%s:%d", config.Host, config.Port),
+		client:   &http.Client{},
+	}
+}
+
+// Endpoint of the registry as given to agents, including credentials if any
+func registryEndpoint(config *cpi.RegistryConfig) string {
+	u := &url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", config.Host, config.Port)}
+	if config.Username != "" {
+		u.User = url.UserPassword(config.Username, config.Password)
+	}
+	return u.String()
+}
+
+func (s *registryAgentEnvService) Create(vmID string, env *cpi.AgentEnv) (err error) {
+	err = s.Update(vmID, env)
+	if err != nil {
+		return
+	}
+
+	s.ctx.Logger.Infof("Creating config drive for VM '%s'", vmID)
+	img, err := createConfigDriveImage(env, registryEndpoint(s.config))
+	if err != nil {
+		return
+	}
+	return attachISO(s.ctx, vmID, img.NewReader())
+}
+
+func (s *registryAgentEnvService) Get(vmID string) (env *cpi.AgentEnv, err error) {
+	body, err := s.do("GET", vmID, nil)
+	if err != nil {
+		return
+	}
+	res := &registrySettingsResponse{}
+	err = json.Unmarshal(body, res)
+	if err != nil {
+		return
+	}
+	env = &cpi.AgentEnv{}
+	err = json.Unmarshal([]byte(res.Settings), env)
+	return
+}
+
+func (s *registryAgentEnvService) Update(vmID string, env *cpi.AgentEnv) (err error) {
+	envJson, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	s.ctx.Logger.Infof("Updating agent env in registry for VM '%s'", vmID)
+	_, err = s.do("PUT", vmID, envJson)
+	return
+}
+
+func (s *registryAgentEnvService) Delete(vmID string) (err error) {
+	s.ctx.Logger.Infof("Deleting agent env from registry for VM '%s'", vmID)
+	_, err = s.do("DELETE", vmID, nil)
+	if err == errRegistryNotFound {
+		err = nil
+	}
+	return
+}
+
+func (s *registryAgentEnvService) do(method string, vmID string, body []byte) (res []byte, err error) {
+	settingsURL := fmt.Sprintf("%s/instances/%s/settings", s.endpoint, vmID)
+	req, err := http.NewRequest(method, settingsURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	res, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = errRegistryNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		err = fmt.Errorf("Registry request %s %s failed with status %d: %s", method, settingsURL, resp.StatusCode, string(res))
+	}
+	return
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/vmware/bosh-photon-cpi/cpi"
+)
+
+// Disk snapshots are stored as Photon images created from the persistent disk.
+// The snapshot CID is the ID of that image.
+func SnapshotDisk(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 1 {
+		return nil, errors.New("Expected at least 1 argument")
+	}
+	diskCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where disk_cid should be")
+	}
+	metadata := map[string]interface{}{}
+	if len(args) > 1 && args[1] != nil {
+		metadata, ok = args[1].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Unexpected argument where metadata should be")
+		}
+	}
+
+	ctx.Logger.Infof("SnapshotDisk with disk_cid: '%s', metadata: '%v'", diskCID, metadata)
+
+	disk, err := ensureDiskExists(ctx, diskCID)
+	if err != nil {
+		return
+	}
+
+	tags := []string{boshTag("disk_cid", diskCID)}
+	for _, vmID := range disk.VMs {
+		tags = append(tags, boshTag("vm_cid", vmID))
+	}
+	for _, key := range diskTagKeys {
+		if value, ok := metadata[key]; ok {
+			tags = append(tags, boshTag(key, value))
+		}
+	}
+
+	spec := &diskImageCreateSpec{
+		Name:            "snapshot-of-" + diskCID,
+		ReplicationType: "ON_DEMAND",
+		Tags:            tags,
+	}
+
+	ctx.Logger.Infof("Creating snapshot with spec: %#v", spec)
+	task, err := createDiskImage(ctx, diskCID, spec)
+	if err == errPhotonEndpointUnsupported {
+		// Director carries on without a snapshot
+		return nil, cpi.NewBoshError(cpi.NotImplementedError, false,
+			"Photon Controller does not support snapshots of disk '%s'", diskCID)
+	}
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	task, err = ctx.Client.Tasks.Wait(task.ID)
+	if err != nil {
+		return
+	}
+	return task.Entity.ID, nil
+}
+
+func DeleteSnapshot(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 1 {
+		return nil, errors.New("Expected at least 1 argument")
+	}
+	snapshotCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where snapshot_cid should be")
+	}
+
+	ctx.Logger.Infof("DeleteSnapshot with snapshot_cid: '%s'", snapshotCID)
+
+	ctx.Logger.Info("Deleting snapshot")
+	task, err := ctx.Client.Images.Delete(snapshotCID)
+	if err != nil {
+		return
+	}
+
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	task, err = ctx.Client.Tasks.Wait(task.ID)
+	if err != nil {
+		return
+	}
+	return nil, nil
+}
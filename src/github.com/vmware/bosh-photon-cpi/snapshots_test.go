@@ -0,0 +1,194 @@
+// Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+//
+// This product is licensed to you under the Apache License, Version 2.0 (the "License").
+// You may not use this product except in compliance with the License.
+//
+// This product may include a number of subcomponents with separate copyright notices and
+// license terms. Your use of these subcomponents is subject to the terms and conditions
+// of the subcomponent's license, as noted in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/vmware/bosh-photon-cpi/cpi"
+	"github.com/vmware/bosh-photon-cpi/logger"
+	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
+)
+
+var _ = Describe("Snapshots", func() {
+	var (
+		server *httptest.Server
+		ctx    *cpi.Context
+	)
+
+	BeforeEach(func() {
+		server = NewMockServer()
+
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
+		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
+			Logger: logger.New(),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("SnapshotDisk", func() {
+		It("returns a snapshot ID tagged with the disk and VM", func() {
+			disk := &ec.PersistentDisk{ID: "fake-disk-id", VMs: []string{"fake-vm-id"}}
+			createTask := &ec.Task{Operation: "CREATE_DISK_IMAGE", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
+			completedTask := &ec.Task{Operation: "CREATE_DISK_IMAGE", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
+
+			var sentSpec diskImageCreateSpec
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/create_image",
+				func(req *http.Request) (*http.Response, error) {
+					json.NewDecoder(req.Body).Decode(&sentSpec)
+					return CreateResponder(200, ToJson(createTask))(req)
+				})
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"snapshot_disk": SnapshotDisk,
+			}
+			metadata := map[string]interface{}{
+				"deployment": "fake-deployment",
+				"job":        "fake-job",
+			}
+			args := []interface{}{"fake-disk-id", metadata}
+			res, err := GetResponse(dispatch(ctx, actions, "snapshot_disk", args))
+
+			Expect(res.Result).Should(Equal(completedTask.Entity.ID))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+
+			Expect(sentSpec.Tags).Should(Equal([]string{
+				"bosh:disk_cid=fake-disk-id",
+				"bosh:vm_cid=fake-vm-id",
+				"bosh:deployment=fake-deployment",
+				"bosh:job=fake-job",
+			}))
+		})
+		It("returns NotImplemented when Photon can't create disk images", func() {
+			disk := &ec.PersistentDisk{ID: "fake-disk-id"}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+disk.ID,
+				CreateResponder(200, ToJson(disk)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/disks/"+disk.ID+"/create_image",
+				CreateResponder(404, ""))
+
+			actions := map[string]cpi.ActionFn{
+				"snapshot_disk": SnapshotDisk,
+			}
+			args := []interface{}{"fake-disk-id", map[string]interface{}{}}
+			res, err := GetResponse(dispatch(ctx, actions, "snapshot_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.NotImplementedError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("returns an error when disk not found", func() {
+			apiError := ec.ApiError{HttpStatusCode: 404, Code: "DiskNotFound", Message: ""}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/disks/"+"fake-disk-id",
+				CreateResponder(404, ToJson(apiError)))
+
+			actions := map[string]cpi.ActionFn{
+				"snapshot_disk": SnapshotDisk,
+			}
+			args := []interface{}{"fake-disk-id", map[string]interface{}{}}
+			res, err := GetResponse(dispatch(ctx, actions, "snapshot_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.DiskNotFoundError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given no arguments", func() {
+			actions := map[string]cpi.ActionFn{
+				"snapshot_disk": SnapshotDisk,
+			}
+			args := []interface{}{}
+			res, err := GetResponse(dispatch(ctx, actions, "snapshot_disk", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+
+	Describe("DeleteSnapshot", func() {
+		It("returns nothing when the snapshot is deleted", func() {
+			deleteTask := &ec.Task{Operation: "DELETE_IMAGE", State: "QUEUED", ID: "fake-delete-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_IMAGE", State: "COMPLETED", ID: "fake-delete-task-id", Entity: ec.Entity{ID: "fake-image-id"}}
+
+			RegisterResponder(
+				"DELETE",
+				server.URL+rootUrl+"/images/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_snapshot": DeleteSnapshot,
+			}
+			args := []interface{}{"fake-image-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_snapshot", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given an invalid argument", func() {
+			actions := map[string]cpi.ActionFn{
+				"delete_snapshot": DeleteSnapshot,
+			}
+			args := []interface{}{5}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_snapshot", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+})
@@ -10,9 +10,138 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/vmware/bosh-photon-cpi/cpi"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
 )
 
+// Metadata key holding the "deployment/job/index" name of the VM
+const vmNameMetadataKey = "bosh-vm-name"
+
+// Name given to VMs when the create_vm env has no group to name them after
+const defaultVMName = "bosh-vm"
+
+// Longest VM name used, the same limit as for a host name label
+const maxVMNameLength = 63
+
+// BOSH metadata keys that are also set as VM tags so BOSH VMs can be found in Photon
+var vmTagKeys = []string{"director", "deployment", "job", "index"}
+
 func SetVmMetadata(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
+	if len(args) < 2 {
+		return nil, errors.New("Expected at least 2 arguments")
+	}
+	vmCID, ok := args[0].(string)
+	if !ok {
+		return nil, errors.New("Unexpected argument where vm_cid should be")
+	}
+	metadata, ok := args[1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected argument where metadata should be")
+	}
+
+	ctx.Logger.Infof("SetVmMetadata with vm_cid: '%s', metadata: '%v'", vmCID, metadata)
+
+	vm, err := ensureVMExists(ctx, vmCID)
+	if err != nil {
+		return
+	}
+
+	// Start from the existing metadata so the agent env stays in place
+	vmMetadata := map[string]string{}
+	for key, value := range vm.Metadata {
+		vmMetadata[key] = value
+	}
+	for key, value := range metadata {
+		if key == metadataKey {
+			ctx.Logger.Infof("Ignoring metadata with reserved key '%s'", key)
+			continue
+		}
+		vmMetadata[key] = fmt.Sprint(value)
+	}
+	if name := vmDisplayName(metadata); name != "" {
+		vmMetadata[vmNameMetadataKey] = name
+	}
+
+	ctx.Logger.Info("Updating metadata for VM")
+	// Task returns instantly for SetMetadata
+	_, err = ctx.Client.VMs.SetMetadata(vmCID, &ec.VmMetadata{Metadata: vmMetadata})
+	if err != nil {
+		return
+	}
+
+	for _, key := range vmTagKeys {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		tag := boshTag(key, value)
+		if hasTag(vm.Tags, tag) {
+			continue
+		}
+
+		ctx.Logger.Infof("Setting tag '%s' on VM", tag)
+		task, err := ctx.Client.VMs.SetTag(vmCID, &ec.VmTag{Tag: tag})
+		if err != nil {
+			return nil, err
+		}
+		ctx.Logger.Infof("Waiting on task: %#v", task)
+		_, err = ctx.Client.Tasks.Wait(task.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
+
+// Returns the "deployment/job/index" name for a VM, or an empty string when
+// the metadata doesn't identify a job instance.
+func vmDisplayName(metadata map[string]interface{}) string {
+	parts := []string{}
+	for _, key := range []string{"deployment", "job", "index"} {
+		value, ok := metadata[key]
+		if !ok {
+			return ""
+		}
+		parts = append(parts, fmt.Sprint(value))
+	}
+	return strings.Join(parts, "/")
+}
+
+// Returns the name to create a VM with. Photon can't rename a VM once it is
+// created, and the instance index is only known from set_vm_metadata later on,
+// so the name comes from the "<director>-<deployment>-<job>" group the director
+// passes in the create_vm env. Anything but lowercase letters, digits and
+// dashes is replaced so the name is also usable as a host name.
+func vmCreateName(env map[string]interface{}) string {
+	bosh, ok := env["bosh"].(map[string]interface{})
+	if !ok {
+		return defaultVMName
+	}
+	group, ok := bosh["group"].(string)
+	if !ok {
+		return defaultVMName
+	}
+
+	name := []rune{}
+	for _, r := range strings.ToLower(group) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			name = append(name, r)
+		case len(name) > 0:
+			name = append(name, '-')
+		}
+	}
+	if len(name) > maxVMNameLength {
+		name = name[:maxVMNameLength]
+	}
+	res := strings.Trim(string(name), "-")
+	if res == "" || res[0] < 'a' || res[0] > 'z' {
+		return defaultVMName
+	}
+	return res
+}
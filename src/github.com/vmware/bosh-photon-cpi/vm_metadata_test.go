@@ -10,31 +10,190 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/vmware/bosh-photon-cpi/cpi"
 	"github.com/vmware/bosh-photon-cpi/logger"
 	. "github.com/vmware/bosh-photon-cpi/mocks"
+	ec "github.com/vmware/photon-controller-go-sdk/photon"
 )
 
 var _ = Describe("VM metadata", func() {
 	var (
-		ctx *cpi.Context
+		server *httptest.Server
+		ctx    *cpi.Context
 	)
 
 	BeforeEach(func() {
+		server = NewMockServer()
+
+		Activate(true)
+		httpClient := &http.Client{Transport: DefaultMockTransport}
 		ctx = &cpi.Context{
+			Client: ec.NewTestClient(server.URL, nil, httpClient),
+			Config: &cpi.Config{
+				Photon: &cpi.PhotonConfig{
+					Target:    server.URL,
+					ProjectID: "fake-project-id",
+				},
+			},
 			Logger: logger.New(),
 		}
 	})
 
-	It("set_vm_metadata is a nop", func() {
-		actions := map[string]cpi.ActionFn{
-			"set_vm_metadata": SetVmMetadata,
-		}
-		res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", nil))
-		Expect(res.Result).To(BeNil())
-		Expect(err).To(BeNil())
-		Expect(res.Log).ShouldNot(BeEmpty())
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("SetVmMetadata", func() {
+		It("sets metadata and tags while keeping the agent env", func() {
+			vm := &ec.VM{
+				ID:       "fake-vm-id",
+				Metadata: map[string]string{"bosh-cpi": "fake-agent-env"},
+				Tags:     []string{"bosh:director=fake-director"},
+			}
+			metadataTask := &ec.Task{State: "COMPLETED"}
+			tagTask := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			tagCompletedTask := &ec.Task{Operation: "SET_TAG", State: "COMPLETED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			var sentMetadata ec.VmMetadata
+			sentTags := []string{}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+vm.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+vm.ID+"/set_metadata",
+				func(req *http.Request) (*http.Response, error) {
+					json.NewDecoder(req.Body).Decode(&sentMetadata)
+					return CreateResponder(200, ToJson(metadataTask))(req)
+				})
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+vm.ID+"/tags",
+				func(req *http.Request) (*http.Response, error) {
+					tag := ec.VmTag{}
+					json.NewDecoder(req.Body).Decode(&tag)
+					sentTags = append(sentTags, tag.Tag)
+					return CreateResponder(200, ToJson(tagTask))(req)
+				})
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+tagTask.ID,
+				CreateResponder(200, ToJson(tagCompletedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"set_vm_metadata": SetVmMetadata,
+			}
+			metadata := map[string]interface{}{
+				"director":   "fake-director",
+				"deployment": "fake-deployment",
+				"job":        "fake-job",
+				"index":      "0",
+				"bosh-cpi":   "overwritten",
+			}
+			args := []interface{}{"fake-vm-id", metadata}
+			res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+
+			Expect(sentMetadata.Metadata).Should(Equal(map[string]string{
+				"bosh-cpi":     "fake-agent-env",
+				"director":     "fake-director",
+				"deployment":   "fake-deployment",
+				"job":          "fake-job",
+				"index":        "0",
+				"bosh-vm-name": "fake-deployment/fake-job/0",
+			}))
+			Expect(sentTags).Should(Equal([]string{
+				"bosh:deployment=fake-deployment",
+				"bosh:job=fake-job",
+				"bosh:index=0",
+			}))
+		})
+		It("returns an error when VM not found", func() {
+			apiError := ec.ApiError{HttpStatusCode: 404, Code: "VMNotFound", Message: ""}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+"fake-vm-id",
+				CreateResponder(404, ToJson(apiError)))
+
+			actions := map[string]cpi.ActionFn{
+				"set_vm_metadata": SetVmMetadata,
+			}
+			args := []interface{}{"fake-vm-id", map[string]interface{}{"job": "fake-job"}}
+			res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.VMNotFoundError))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given no arguments", func() {
+			actions := map[string]cpi.ActionFn{
+				"set_vm_metadata": SetVmMetadata,
+			}
+			args := []interface{}{}
+			res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should return an error when given an invalid argument", func() {
+			actions := map[string]cpi.ActionFn{
+				"set_vm_metadata": SetVmMetadata,
+			}
+			args := []interface{}{"fake-vm-id", 5}
+			res, err := GetResponse(dispatch(ctx, actions, "set_vm_metadata", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+	})
+
+	Describe("vmCreateName", func() {
+		It("names the VM after the group in the env", func() {
+			env := map[string]interface{}{
+				"bosh": map[string]interface{}{"group": "fake-director-fake-deployment-fake-job"},
+			}
+			Expect(vmCreateName(env)).Should(Equal("fake-director-fake-deployment-fake-job"))
+		})
+		It("replaces characters that can't be used in a host name", func() {
+			env := map[string]interface{}{
+				"bosh": map[string]interface{}{"group": "My_Director-cf.prod-router"},
+			}
+			Expect(vmCreateName(env)).Should(Equal("my-director-cf-prod-router"))
+		})
+		It("shortens long names", func() {
+			env := map[string]interface{}{
+				"bosh": map[string]interface{}{"group": strings.Repeat("a", 100)},
+			}
+			Expect(vmCreateName(env)).Should(HaveLen(maxVMNameLength))
+		})
+		It("uses the default name without a usable group", func() {
+			Expect(vmCreateName(map[string]interface{}{})).Should(Equal(defaultVMName))
+			Expect(vmCreateName(map[string]interface{}{
+				"bosh": map[string]interface{}{"password": "fake-password"},
+			})).Should(Equal(defaultVMName))
+			Expect(vmCreateName(map[string]interface{}{
+				"bosh": map[string]interface{}{"group": "0-1"},
+			})).Should(Equal(defaultVMName))
+		})
 	})
 })
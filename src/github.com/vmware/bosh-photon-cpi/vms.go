@@ -30,6 +30,12 @@ const (
 	VMAttachedDiskSizeGBElement = "vm_attached_disk_size_gb"
 )
 
+// Name of the ephemeral disk created with every VM, and the device it shows up as
+const (
+	ephemeralDiskName = "bosh-ephemeral-disk"
+	ephemeralDiskPath = "/dev/sdb"
+)
+
 var ErrCloudPropsValues = errors.New("error in cloud props properties")
 
 func ParseCloudProps(cloudPropsMap map[string]interface{}) (cloudProps CloudProps, err error) {
@@ -62,31 +68,6 @@ func ParseDiskCIDList(diskCIDList []interface{}) (affinities []ec.LocalitySpec,
 	return
 }
 
-func ParseNetworks(networks map[string]interface{}) (networkList []string, err error) {
-	for _, network := range networks {
-		networkMap, ok := network.(map[string]interface{})
-		if !ok {
-			err = errors.New("error in networks")
-			return
-		}
-
-		cp, ok := networkMap["cloud_properties"].(map[string]interface{})
-		if !ok {
-			err = errors.New("error in networks:cloud_properties")
-			return
-		}
-
-		network_id, ok := cp["network_id"].(string)
-		if !ok {
-			err = errors.New("error in networks:cloud_properties:network_id")
-			return
-		}
-
-		networkList = append(networkList, network_id)
-	}
-	return
-}
-
 func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 6 {
 		return nil, errors.New("Expected at least 6 arguments")
@@ -114,10 +95,19 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		return nil, errors.New("Unexpected argument where networks should be")
 	}
 
-	networkList, err := ParseNetworks(networks)
+	vmNetworks, err := ParseNetworks(networks)
 	if err != nil {
 		return nil, err
 	}
+	err = resolveNetworks(ctx, vmNetworks)
+	if err != nil {
+		return
+	}
+
+	agentEnvService, err := newAgentEnvService(ctx)
+	if err != nil {
+		return
+	}
 
 	diskCIDList, ok := args[4].([]interface{})
 	if !ok {
@@ -136,18 +126,26 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 
 	ctx.Logger.Infof(
 		"CreateVM with agent_id: '%v', stemcell_cid: '%v', cloud_properties: '%v', networks: '%v', env: '%v', affiniteis: '%v'",
-		agentID, stemcellCID, cloudProps, networkList, env, affinities)
+		agentID, stemcellCID, cloudProps, vmNetworks, env, affinities)
+
+	err = validateFlavor(ctx, vmFlavorKind, cloudProps.VMFlavor)
+	if err != nil {
+		return
+	}
+	err = validateFlavor(ctx, ephemeralDiskKind, cloudProps.DiskFlavor)
+	if err != nil {
+		return
+	}
 
-	ephDiskName := "bosh-ephemeral-disk"
 	spec := &ec.VmCreateSpec{
-		Name:          "bosh-vm",
+		Name:          vmCreateName(env),
 		Flavor:        cloudProps.VMFlavor,
 		SourceImageID: stemcellCID,
 		AttachedDisks: []ec.AttachedDisk{
 			ec.AttachedDisk{
 				CapacityGB: 50, // Ignored
 				Flavor:     cloudProps.DiskFlavor,
-				Kind:       "ephemeral-disk",
+				Kind:       ephemeralDiskKind,
 				Name:       "boot-disk",
 				State:      "STARTED",
 				BootDisk:   true,
@@ -155,20 +153,29 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 			ec.AttachedDisk{
 				CapacityGB: cloudProps.VMAttachedDiskSizeGB,
 				Flavor:     cloudProps.DiskFlavor,
-				Kind:       "ephemeral-disk",
-				Name:       ephDiskName,
+				Kind:       ephemeralDiskKind,
+				Name:       ephemeralDiskName,
 				State:      "STARTED",
 				BootDisk:   false,
 			},
 		},
 		Affinities: affinities,
-		Subnets:    networkList,
+		Subnets:    subnetIDs(vmNetworks),
 	}
 	ctx.Logger.Infof("Creating VM with spec: %#v", spec)
 	vmTask, err := ctx.Client.Projects.CreateVM(ctx.Config.Photon.ProjectID, spec)
 	if err != nil {
 		return
 	}
+
+	// From here on the VM exists, so don't leave it behind if a later step fails
+	vmID := vmTask.Entity.ID
+	defer func() {
+		if err != nil && vmID != "" {
+			cleanupFailedVM(ctx, vmID, agentEnvService)
+		}
+	}()
+
 	ctx.Logger.Infof("Waiting on task: %#v", vmTask)
 	vmTask, err = ctx.Client.Tasks.Wait(vmTask.ID)
 	if err != nil {
@@ -183,7 +190,7 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 	}
 	diskID := ""
 	for _, disk := range vm.AttachedDisks {
-		if disk.Name == ephDiskName {
+		if disk.Name == ephemeralDiskName {
 			diskID = disk.ID
 			break
 		}
@@ -194,18 +201,27 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		return
 	}
 
+	if len(vmNetworks) > 0 {
+		connections, netErr := getVMNetworks(ctx, vm.ID)
+		if netErr != nil {
+			ctx.Logger.Warnf("Could not get MAC addresses of VM %s, agent will configure NICs in order: %v", vm.ID, netErr)
+		} else {
+			setNetworkMACs(vmNetworks, connections)
+		}
+	}
+
 	// Create agent config
 	agentEnv := &cpi.AgentEnv{
 		AgentID:  agentID,
 		VM:       cpi.VMSpec{Name: vm.Name, ID: vm.ID},
-		Networks: networks,
+		Networks: agentNetworks(vmNetworks),
 		Env:      env,
 		Mbus:     ctx.Config.Agent.Mbus,
 		NTP:      ctx.Config.Agent.NTP,
 		Disks: map[string]interface{}{
 			"ephemeral": map[string]interface{}{
 				"id":   diskID,
-				"path": "/dev/sdb"},
+				"path": ephemeralDiskPath},
 		},
 		Blobstore: cpi.BlobstoreSpec{
 			Provider: ctx.Config.Agent.Blobstore.Provider,
@@ -213,8 +229,8 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		},
 	}
 
-	// Create and attach agent env ISO file
-	err = updateAgentEnv(ctx, vmTask.Entity.ID, agentEnv)
+	// Make agent env available to the VM before it boots
+	err = agentEnvService.Create(vmTask.Entity.ID, agentEnv)
 	if err != nil {
 		return
 	}
@@ -230,9 +246,97 @@ func CreateVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 		return
 	}
 
+	// CPI API v2 returns the network settings alongside the VM CID, including
+	// the addresses leased to dynamic networks. With v1 the director learns
+	// those from the agent instead.
+	if ctx.ApiVersion >= cpi.ApiVersion2 {
+		err = waitForDynamicNetworkIPs(ctx, vmTask.Entity.ID, vmNetworks)
+		if err != nil {
+			ctx.Logger.Warnf("Returning networks without dynamic addresses: %v", err)
+		}
+		return []interface{}{vmTask.Entity.ID, agentNetworks(vmNetworks)}, nil
+	}
 	return vmTask.Entity.ID, nil
 }
 
+// Deletes a VM that create_vm could not finish, unless configured to keep it.
+// Photon deletes the ephemeral disks of a VM along with it.
+func cleanupFailedVM(ctx *cpi.Context, vmID string, agentEnvService agentEnvService) {
+	if ctx.Config.KeepFailedVMs {
+		ctx.Logger.Warnf("Keeping failed VM %s for debugging, it has to be deleted manually", vmID)
+		return
+	}
+
+	ctx.Logger.Warnf("Deleting failed VM %s", vmID)
+	err := deleteFailedVM(ctx, vmID)
+	if err != nil {
+		ctx.Logger.Errorf("Could not delete failed VM %s, it has to be deleted manually: %v", vmID, err)
+		return
+	}
+	ctx.Logger.Infof("Deleted failed VM %s", vmID)
+
+	err = agentEnvService.Delete(vmID)
+	if err != nil {
+		ctx.Logger.Warnf("Could not delete agent env of failed VM %s: %v", vmID, err)
+	}
+}
+
+func deleteFailedVM(ctx *cpi.Context, vmID string) (err error) {
+	vm, err := ctx.Client.VMs.Get(vmID)
+	if err != nil {
+		return
+	}
+	err = stopVM(ctx, vm)
+	if err != nil {
+		return
+	}
+	return removeVM(ctx, vm)
+}
+
+func detachDiskFromVM(ctx *cpi.Context, vmID string, diskID string) (err error) {
+	ctx.Logger.Infof("Detaching disk: %s", diskID)
+	detachOp := &ec.VmDiskOperation{DiskID: diskID}
+	detachTask, err := ctx.Client.VMs.DetachDisk(vmID, detachOp)
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", detachTask)
+	_, err = ctx.Client.Tasks.Wait(detachTask.ID)
+	return
+}
+
+// Powers off the VM, unless it is not running, in which case Photon would fail the stop task
+func stopVM(ctx *cpi.Context, vm *ec.VM) (err error) {
+	if vm.State != "STARTED" && vm.State != "SUSPENDED" {
+		ctx.Logger.Infof("Not stopping VM %s in state %s", vm.ID, vm.State)
+		return
+	}
+	ctx.Logger.Info("Stopping VM")
+	offTask, err := ctx.Client.VMs.Stop(vm.ID)
+	if err != nil {
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", offTask)
+	_, err = ctx.Client.Tasks.Wait(offTask.ID)
+	return
+}
+
+// Deletes a stopped VM. A VM deleted concurrently counts as deleted.
+func removeVM(ctx *cpi.Context, vm *ec.VM) (err error) {
+	ctx.Logger.Info("Deleting VM")
+	task, err := ctx.Client.VMs.Delete(vm.ID)
+	if err != nil {
+		if apiErr, ok := err.(ec.ApiError); ok && apiErr.HttpStatusCode == http.StatusNotFound {
+			ctx.Logger.Infof("VM %s is already deleted", vm.ID)
+			return nil
+		}
+		return
+	}
+	ctx.Logger.Infof("Waiting on task: %#v", task)
+	_, err = ctx.Client.Tasks.Wait(task.ID)
+	return
+}
+
 func DeleteVM(ctx *cpi.Context, args []interface{}) (result interface{}, err error) {
 	if len(args) < 1 {
 		return nil, errors.New("Expected at least 1 argument")
@@ -244,55 +348,48 @@ func DeleteVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 
 	ctx.Logger.Infof("Deleting VM: %s", vmCID)
 
-	_, err = ensureVMExists(ctx, vmCID)
+	agentEnvService, err := newAgentEnvService(ctx)
 	if err != nil {
 		return
 	}
 
-	ctx.Logger.Info("Detaching disks")
-	// Detach any attached disks first
-	disks, err := ctx.Client.Projects.GetDisks(ctx.Config.Photon.ProjectID, nil)
+	// The director retries delete_vm after partial failures, so a VM that is
+	// already gone counts as deleted
+	vm, found, err := hasVM(ctx, vmCID)
 	if err != nil {
 		return
 	}
-	for _, disk := range disks.Items {
-		for _, vmID := range disk.VMs {
-			if vmID == vmCID {
-				ctx.Logger.Infof("Detaching disk: %s", disk.ID)
-				detachOp := &ec.VmDiskOperation{DiskID: disk.ID}
-				detachTask, err := ctx.Client.VMs.DetachDisk(vmCID, detachOp)
-				if err != nil {
-					return nil, err
-				}
-				ctx.Logger.Infof("Waiting on task: %#v", detachTask)
-				detachTask, err = ctx.Client.Tasks.Wait(detachTask.ID)
-				if err != nil {
-					return nil, err
-				}
-			}
+	if !found {
+		ctx.Logger.Infof("VM %s is already deleted", vmCID)
+		if envErr := agentEnvService.Delete(vmCID); envErr != nil {
+			ctx.Logger.Errorf("Failed to delete agent env for VM '%s': %v", vmCID, envErr)
 		}
+		return nil, nil
 	}
 
-	ctx.Logger.Info("Stopping VM")
-	offTask, err := ctx.Client.VMs.Stop(vmCID)
-	if err != nil {
-		return
+	ctx.Logger.Info("Detaching disks")
+	// Detach any attached disks first
+	for _, diskID := range persistentDiskIDs(vm) {
+		// A disk may have been detached by an earlier attempt. If it is in fact
+		// still attached, Photon refuses to delete the VM below.
+		if detachErr := detachDiskFromVM(ctx, vmCID, diskID); detachErr != nil {
+			ctx.Logger.Warnf("Could not detach disk %s, continuing: %v", diskID, detachErr)
+		}
 	}
-	ctx.Logger.Infof("Waiting on task: %#v", offTask)
-	offTask, err = ctx.Client.Tasks.Wait(offTask.ID)
+
+	err = stopVM(ctx, vm)
 	if err != nil {
 		return
 	}
 
-	ctx.Logger.Info("Deleting VM")
-	task, err := ctx.Client.VMs.Delete(vmCID)
+	err = removeVM(ctx, vm)
 	if err != nil {
 		return
 	}
-	ctx.Logger.Infof("Waiting on task: %#v", task)
-	_, err = ctx.Client.Tasks.Wait(task.ID)
-	if err != nil {
-		return
+
+	// The VM is gone at this point, so a stale agent env is not worth failing over
+	if envErr := agentEnvService.Delete(vmCID); envErr != nil {
+		ctx.Logger.Errorf("Failed to delete agent env for VM '%s': %v", vmCID, envErr)
 	}
 	return nil, nil
 }
@@ -326,6 +423,8 @@ func RebootVM(ctx *cpi.Context, args []interface{}) (result interface{}, err err
 
 	ctx.Logger.Infof("Rebooting VM: %s", vmCID)
 
+	// Photon's restart operation is a power reset rather than a guest restart,
+	// so it is no gentler than stopping and starting the VM
 	ctx.Logger.Info("Stopping VM")
 	stopTask, err := ctx.Client.VMs.Stop(vmCID)
 	if err != nil {
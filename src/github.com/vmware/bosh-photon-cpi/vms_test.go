@@ -10,6 +10,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
@@ -118,6 +119,21 @@ var _ = Describe("VMs", func() {
 	})
 
 	Describe("CreateVM", func() {
+		BeforeEach(func() {
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=vm",
+				CreateResponder(200, ToJson(&ec.FlavorList{Items: []ec.Flavor{
+					ec.Flavor{Name: "fake-flavor", Kind: "vm"},
+				}})))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/flavors?kind=ephemeral-disk",
+				CreateResponder(200, ToJson(&ec.FlavorList{Items: []ec.Flavor{
+					ec.Flavor{Name: "fake-flavor", Kind: "ephemeral-disk"},
+				}})))
+		})
+
 		It("should return ID of created VM", func() {
 			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
@@ -137,6 +153,8 @@ var _ = Describe("VMs", func() {
 				},
 			}
 			metadataTask := &ec.Task{State: "COMPLETED"}
+			tagTask := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			tagCompletedTask := &ec.Task{Operation: "SET_TAG", State: "COMPLETED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 
 			RegisterResponder(
 				"POST",
@@ -170,6 +188,14 @@ var _ = Describe("VMs", func() {
 				"POST",
 				server.URL+rootUrl+"/vms/fake-vm-id/set_metadata",
 				CreateResponder(200, ToJson(metadataTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/tags",
+				CreateResponder(200, ToJson(tagTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+tagTask.ID,
+				CreateResponder(200, ToJson(tagCompletedTask)))
 
 			RegisterResponder(
 				"GET",
@@ -205,6 +231,135 @@ var _ = Describe("VMs", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
+		It("should return ID of created VM and networks with API version 2", func() {
+			networks := map[string]interface{}{
+				"default": map[string]interface{}{
+					"ip":               "10.0.0.5",
+					"cloud_properties": map[string]interface{}{"network_id": "fake-network-id"},
+				},
+			}
+			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			isoTask := &ec.Task{Operation: "ATTACH_ISO", State: "QUEUED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			isoCompletedTask := &ec.Task{Operation: "ATTACH_ISO", State: "COMPLETED", ID: "fake-iso-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			onTask := &ec.Task{Operation: "START_VM", State: "QUEUED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			onCompletedTask := &ec.Task{Operation: "START_VM", State: "COMPLETED", ID: "fake-on-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			detachTask := &ec.Task{Operation: "DETACH_ISO", State: "ERROR", ID: "fake-detach-id"}
+
+			vm := &ec.VM{
+				ID: createTask.Entity.ID,
+				AttachedDisks: []ec.AttachedDisk{
+					ec.AttachedDisk{Name: "bosh-ephemeral-disk", ID: "fake-eph-disk-id"},
+				},
+			}
+			metadataTask := &ec.Task{State: "COMPLETED"}
+			tagTask := &ec.Task{Operation: "SET_TAG", State: "QUEUED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			tagCompletedTask := &ec.Task{Operation: "SET_TAG", State: "COMPLETED", ID: "fake-tag-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			networksTask := &ec.Task{Operation: "GET_NETWORKS", State: "QUEUED", ID: "fake-networks-task-id"}
+			networksCompletedTask := &ec.Task{
+				Operation: "GET_NETWORKS",
+				State:     "COMPLETED",
+				ID:        "fake-networks-task-id",
+				ResourceProperties: &vmNetworkConnections{
+					NetworkConnections: []networkConnection{
+						networkConnection{Network: "fake-network-id", MacAddress: "00:50:56:00:00:01"},
+					},
+				},
+			}
+
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/projects/"+projID+"/vms",
+				CreateResponder(200, ToJson(createTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+createTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID+"/attach_iso",
+				CreateResponder(200, ToJson(isoTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID+"/detach_iso",
+				CreateResponder(200, ToJson(detachTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID+"/operations",
+				CreateResponder(200, ToJson(onTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID+"/start",
+				CreateResponder(200, ToJson(onTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/set_metadata",
+				CreateResponder(200, ToJson(metadataTask)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/fake-vm-id/tags",
+				CreateResponder(200, ToJson(tagTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+tagTask.ID,
+				CreateResponder(200, ToJson(tagCompletedTask)))
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+createTask.Entity.ID+"/subnets",
+				CreateResponder(200, ToJson(networksTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+networksTask.ID,
+				CreateResponder(200, ToJson(networksCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+isoTask.ID,
+				CreateResponder(200, ToJson(isoCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+onCompletedTask.ID,
+				CreateResponder(200, ToJson(onCompletedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+detachTask.ID,
+				CreateResponder(200, ToJson(detachTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "fake-flavor",
+					"disk_flavor": "fake-flavor",
+				}, // cloud_properties
+				networks,                 // networks
+				[]interface{}{},          // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			ctx.ApiVersion = cpi.ApiVersion2
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(HaveLen(2))
+			Expect(res.Result.([]interface{})[0]).Should(Equal(completedTask.Entity.ID))
+			resNetwork := res.Result.([]interface{})[1].(map[string]interface{})["default"].(map[string]interface{})
+			Expect(resNetwork["ip"]).Should(Equal("10.0.0.5"))
+			Expect(resNetwork["mac"]).Should(Equal("00:50:56:00:00:01"))
+			Expect(resNetwork["default"]).Should(Equal([]interface{}{"dns", "gateway"}))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
 		It("should return an error when server returns error", func() {
 			createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 			completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
@@ -239,6 +394,110 @@ var _ = Describe("VMs", func() {
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
+		Context("when a step after creating the VM fails", func() {
+			var (
+				deleted bool
+				args    []interface{}
+			)
+
+			BeforeEach(func() {
+				createTask := &ec.Task{Operation: "CREATE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+				completedTask := &ec.Task{Operation: "CREATE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+				deleteTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-delete-task-id"}
+
+				// No ephemeral disk, so create_vm fails after the VM was created
+				vm := &ec.VM{ID: createTask.Entity.ID, State: "STOPPED"}
+
+				deleted = false
+				RegisterResponder(
+					"POST",
+					server.URL+rootUrl+"/projects/"+projID+"/vms",
+					CreateResponder(200, ToJson(createTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+rootUrl+"/tasks/"+createTask.ID,
+					CreateResponder(200, ToJson(completedTask)))
+				RegisterResponder(
+					"GET",
+					server.URL+rootUrl+"/vms/"+createTask.Entity.ID,
+					CreateResponder(200, ToJson(vm)))
+				RegisterResponder(
+					"DELETE",
+					server.URL+rootUrl+"/vms/"+createTask.Entity.ID,
+					func(req *http.Request) (*http.Response, error) {
+						deleted = true
+						return CreateResponder(200, ToJson(deleteTask))(req)
+					})
+				RegisterResponder(
+					"GET",
+					server.URL+rootUrl+"/tasks/"+deleteTask.ID,
+					CreateResponder(200, ToJson(deleteTask)))
+
+				args = []interface{}{
+					"agent-id",
+					"fake-stemcell-id",
+					map[string]interface{}{
+						"vm_flavor":   "fake-flavor",
+						"disk_flavor": "fake-flavor",
+					}, // cloud_properties
+					map[string]interface{}{}, // networks
+					[]interface{}{},          // disk_cids
+					map[string]interface{}{}, // environment
+				}
+			})
+
+			It("should delete the failed VM", func() {
+				actions := map[string]cpi.ActionFn{
+					"create_vm": CreateVM,
+				}
+				res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+				Expect(res.Result).Should(BeNil())
+				Expect(res.Error).ShouldNot(BeNil())
+				Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+				Expect(deleted).Should(BeTrue())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.Log).Should(ContainSubstring("Deleted failed VM fake-vm-id"))
+			})
+			It("should keep the failed VM when configured to", func() {
+				ctx.Config.KeepFailedVMs = true
+				actions := map[string]cpi.ActionFn{
+					"create_vm": CreateVM,
+				}
+				res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+				Expect(res.Result).Should(BeNil())
+				Expect(res.Error).ShouldNot(BeNil())
+				Expect(deleted).Should(BeFalse())
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(res.Log).Should(ContainSubstring("Keeping failed VM fake-vm-id"))
+			})
+		})
+		It("should return an error when the VM flavor does not exist", func() {
+			actions := map[string]cpi.ActionFn{
+				"create_vm": CreateVM,
+			}
+			args := []interface{}{
+				"agent-id",
+				"fake-stemcell-id",
+				map[string]interface{}{
+					"vm_flavor":   "missing-flavor",
+					"disk_flavor": "fake-flavor",
+				},
+				map[string]interface{}{}, // networks
+				[]interface{}{},          // disk_cids
+				map[string]interface{}{}, // environment
+			}
+			res, err := GetResponse(dispatch(ctx, actions, "create_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).ShouldNot(BeNil())
+			Expect(res.Error.Type).Should(Equal(cpi.CloudError))
+			Expect(res.Error.Message).Should(ContainSubstring("missing-flavor"))
+			Expect(res.Error.Message).Should(ContainSubstring("fake-flavor"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
 		It("should return an error when cloud_properties has bad property type", func() {
 			actions := map[string]cpi.ActionFn{
 				"create_vm": CreateVM,
@@ -289,7 +548,10 @@ var _ = Describe("VMs", func() {
 
 	Describe("DeleteVM", func() {
 		It("should return nothing when successful", func() {
-			vm := &ec.VM{ID: "fake-vm-id"}
+			vm := &ec.VM{ID: "fake-vm-id", State: "STARTED", AttachedDisks: []ec.AttachedDisk{
+				ec.AttachedDisk{ID: "fake-eph-disk-id", Kind: "ephemeral-disk"},
+				ec.AttachedDisk{ID: "fake-disk-1", Kind: "persistent-disk"},
+			}}
 
 			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
@@ -297,12 +559,10 @@ var _ = Describe("VMs", func() {
 			offTask := &ec.Task{Operation: "STOP_VM", State: "QUEUED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 			offCompletedTask := &ec.Task{Operation: "STOP_VM", State: "COMPLETED", ID: "fake-off-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
 
-			disks := &ec.DiskList{[]ec.PersistentDisk{
-				ec.PersistentDisk{ID: "fake-disk-1", VMs: []string{completedTask.Entity.ID}},
-			}}
 			detachQueuedTask := &ec.Task{Operation: "DETACH_DISK", State: "QUEUED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
 			detachCompletedTask := &ec.Task{Operation: "DETACH_DISK", State: "COMPLETED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
 
+			detached := []string{}
 			RegisterResponder(
 				"GET",
 				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID,
@@ -318,7 +578,12 @@ var _ = Describe("VMs", func() {
 			RegisterResponder(
 				"POST",
 				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID+"/detach_disk",
-				CreateResponder(200, ToJson(detachQueuedTask)))
+				func(req *http.Request) (*http.Response, error) {
+					op := &ec.VmDiskOperation{}
+					json.NewDecoder(req.Body).Decode(op)
+					detached = append(detached, op.DiskID)
+					return CreateResponder(200, ToJson(detachQueuedTask))(req)
+				})
 			RegisterResponder(
 				"GET",
 				server.URL+rootUrl+"/tasks/"+detachCompletedTask.ID,
@@ -331,10 +596,45 @@ var _ = Describe("VMs", func() {
 				"GET",
 				server.URL+rootUrl+"/tasks/"+offCompletedTask.ID,
 				CreateResponder(200, ToJson(offCompletedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(detached).Should(Equal([]string{"fake-disk-1"}))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should not stop a VM that is already stopped", func() {
+			vm := &ec.VM{ID: "fake-vm-id", State: "STOPPED"}
+
+			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			stopped := false
 			RegisterResponder(
 				"GET",
-				server.URL+rootUrl+"/projects/"+projID+"/disks",
-				CreateResponder(200, ToJson(disks)))
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID+"/stop",
+				func(req *http.Request) (*http.Response, error) {
+					stopped = true
+					return CreateResponder(500, ToJson(ec.ApiError{HttpStatusCode: 500}))(req)
+				})
+			RegisterResponder(
+				"DELETE",
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
 
 			actions := map[string]cpi.ActionFn{
 				"delete_vm": DeleteVM,
@@ -344,10 +644,54 @@ var _ = Describe("VMs", func() {
 
 			Expect(res.Result).Should(BeNil())
 			Expect(res.Error).Should(BeNil())
+			Expect(stopped).Should(BeFalse())
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
-		It("should return an error when VM not found", func() {
+		It("should continue when a disk fails to detach", func() {
+			vm := &ec.VM{ID: "fake-vm-id", State: "STOPPED", AttachedDisks: []ec.AttachedDisk{
+				ec.AttachedDisk{ID: "fake-disk-1", Kind: "persistent-disk"},
+			}}
+
+			deleteTask := &ec.Task{Operation: "DELETE_VM", State: "QUEUED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+			completedTask := &ec.Task{Operation: "DELETE_VM", State: "COMPLETED", ID: "fake-task-id", Entity: ec.Entity{ID: "fake-vm-id"}}
+
+			detachQueuedTask := &ec.Task{Operation: "DETACH_DISK", State: "QUEUED", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
+			detachErrorTask := &ec.Task{Operation: "DETACH_DISK", State: "ERROR", ID: "fake-disk-task-1", Entity: ec.Entity{ID: "fake-disk-1"}}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"POST",
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID+"/detach_disk",
+				CreateResponder(200, ToJson(detachQueuedTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+detachErrorTask.ID,
+				CreateResponder(200, ToJson(detachErrorTask)))
+			RegisterResponder(
+				"DELETE",
+				server.URL+rootUrl+"/vms/"+deleteTask.Entity.ID,
+				CreateResponder(200, ToJson(deleteTask)))
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/tasks/"+deleteTask.ID,
+				CreateResponder(200, ToJson(completedTask)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).Should(ContainSubstring("Could not detach disk fake-disk-1"))
+		})
+		It("should succeed when VM not found", func() {
 			apiError := ec.ApiError{HttpStatusCode: 404, Code: "VMNotFound", Message: ""}
 
 			RegisterResponder(
@@ -362,8 +706,31 @@ var _ = Describe("VMs", func() {
 			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
 
 			Expect(res.Result).Should(BeNil())
-			Expect(res.Error).ShouldNot(BeNil())
-			Expect(res.Error.Type).Should(Equal(cpi.VMNotFoundError))
+			Expect(res.Error).Should(BeNil())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(res.Log).ShouldNot(BeEmpty())
+		})
+		It("should succeed when VM is deleted while deleting it", func() {
+			vm := &ec.VM{ID: "fake-vm-id", State: "STOPPED"}
+			apiError := ec.ApiError{HttpStatusCode: 404, Code: "VMNotFound", Message: ""}
+
+			RegisterResponder(
+				"GET",
+				server.URL+rootUrl+"/vms/"+"fake-vm-id",
+				CreateResponder(200, ToJson(vm)))
+			RegisterResponder(
+				"DELETE",
+				server.URL+rootUrl+"/vms/"+"fake-vm-id",
+				CreateResponder(404, ToJson(apiError)))
+
+			actions := map[string]cpi.ActionFn{
+				"delete_vm": DeleteVM,
+			}
+			args := []interface{}{"fake-vm-id"}
+			res, err := GetResponse(dispatch(ctx, actions, "delete_vm", args))
+
+			Expect(res.Result).Should(BeNil())
+			Expect(res.Error).Should(BeNil())
 			Expect(err).ShouldNot(HaveOccurred())
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
@@ -392,7 +759,7 @@ var _ = Describe("VMs", func() {
 			Expect(res.Log).ShouldNot(BeEmpty())
 		})
 		Context("when auth is enabled", func() {
-			It("should return an error when VM not found", func() {
+			It("should succeed when VM not found", func() {
 				apiError := ec.ApiError{HttpStatusCode: 403, Code: "AccessForbidden", Message: ""}
 
 				RegisterResponder(
@@ -407,8 +774,7 @@ var _ = Describe("VMs", func() {
 				res, err := GetResponse(dispatch(ctxAuth, actions, "delete_vm", args))
 
 				Expect(res.Result).Should(BeNil())
-				Expect(res.Error).ShouldNot(BeNil())
-				Expect(res.Error.Type).Should(Equal(cpi.VMNotFoundError))
+				Expect(res.Error).Should(BeNil())
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(res.Log).ShouldNot(BeEmpty())
 			})